@@ -2,18 +2,45 @@ package internal
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"time"
 )
 
+// SshRunner Runs commands on the hypervisor. Files are read again on every connection so rotated keys,
+// certificates and known_hosts files are picked up without a restart
 type SshRunner struct {
-	Host       string
-	User       string
-	KnownHosts string
-	PrivateKey string
+	Host           string
+	User           string
+	KnownHosts     string // Path of a known_hosts file, may have @cert-authority lines
+	KnownHostsData string // known_hosts content, used instead of KnownHosts if set
+
+	PrivateKey           string // PEM, used instead of PrivateKeyFile if set
+	PrivateKeyFile       string
+	PrivateKeyPassphrase string
+	Certificate          string // OpenSSH user certificate for the private key, used instead of CertificateFile if set
+	CertificateFile      string
+	AgentSocket          string // ssh-agent socket, e.g. SSH_AUTH_SOCK
+}
+
+// Host key algorithms to offer for each key type in known_hosts
+var hostKeyAlgorithmsByType = map[string][]string{
+	ssh.KeyAlgoRSA: {ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA},
 }
 
-func (r *SshRunner) RunCommand(cmd string) (string, string, error) {
+// Host certificate algorithms, offered if known_hosts trusts a certificate authority
+var hostCertAlgorithms = []string{
+	ssh.CertAlgoED25519v01,
+	ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+	ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01,
+}
+
+func (r *SshRunner) RunCommand(cmd string, stdin []byte) (string, string, error) {
 	conn, err := r.makeClient()
 	if err != nil {
 		return "", "", err
@@ -26,6 +53,10 @@ func (r *SshRunner) RunCommand(cmd string) (string, string, error) {
 	}
 	defer session.Close()
 
+	if stdin != nil {
+		session.Stdin = bytes.NewReader(stdin)
+	}
+
 	var stdout bytes.Buffer
 	session.Stdout = &stdout
 
@@ -37,21 +68,163 @@ func (r *SshRunner) RunCommand(cmd string) (string, string, error) {
 	return stdout.String(), stderr.String(), err
 }
 
+// readSecret Inline value if set, otherwise the content of the file if there is one
+func readSecret(value string, file string) ([]byte, error) {
+	if value != "" || file == "" {
+		return []byte(value), nil
+	}
+	return os.ReadFile(file)
+}
+
+// hostKeyAlgorithms Algorithms matching the keys in known_hosts. Without this the server may pick a host key type
+// (like a certificate) that known_hosts can't verify even though it has another key for the host
+func hostKeyAlgorithms(knownHostsData []byte) []string {
+	var algorithms []string
+	seen := make(map[string]struct{})
+	add := func(names ...string) {
+		for _, name := range names {
+			if _, ok := seen[name]; !ok {
+				seen[name] = struct{}{}
+				algorithms = append(algorithms, name)
+			}
+		}
+	}
+
+	rest := knownHostsData
+	for len(rest) > 0 {
+		marker, _, key, _, next, err := ssh.ParseKnownHosts(rest)
+		if err != nil {
+			break
+		}
+		rest = next
+		switch marker {
+		case "cert-authority":
+			add(hostCertAlgorithms...)
+		case "":
+			if names, ok := hostKeyAlgorithmsByType[key.Type()]; ok {
+				add(names...)
+			} else {
+				add(key.Type())
+			}
+		}
+	}
+	return algorithms
+}
+
+// hostKeyCallback knownhosts only reads files, so known_hosts content is written to a temporary one first
+func (r *SshRunner) hostKeyCallback() (ssh.HostKeyCallback, []string, error) {
+	data, err := readSecret(r.KnownHostsData, r.KnownHosts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.KnownHostsData == "" {
+		callback, err := knownhosts.New(r.KnownHosts)
+		return callback, hostKeyAlgorithms(data), err
+	}
+
+	file, err := os.CreateTemp("", "known_hosts-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		return nil, nil, err
+	}
+	callback, err := knownhosts.New(file.Name())
+	return callback, hostKeyAlgorithms(data), err
+}
+
+// keySigner Signer for the private key, wrapped in the user certificate if there is one
+func (r *SshRunner) keySigner() (ssh.Signer, error) {
+	key, err := readSecret(r.PrivateKey, r.PrivateKeyFile)
+	if err != nil || len(key) == 0 {
+		return nil, err
+	}
+
+	var signer ssh.Signer
+	if r.PrivateKeyPassphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(r.PrivateKeyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	var missingErr *ssh.PassphraseMissingError
+	if errors.As(err, &missingErr) {
+		return nil, errors.New("private key is encrypted and no passphrase is set")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := readSecret(r.Certificate, r.CertificateFile)
+	if err != nil || len(certificate) == 0 {
+		return signer, err
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(certificate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+	cert, ok := publicKey.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("certificate file doesn't hold an OpenSSH certificate")
+	}
+	if validBefore := cert.ValidBefore; validBefore != ssh.CertTimeInfinity && time.Now().Unix() >= int64(validBefore) {
+		return nil, fmt.Errorf("certificate %s expired at %s", cert.KeyId, time.Unix(int64(validBefore), 0))
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// authMethods Public key authentication with the configured key (or certificate) first, then the agent's keys.
+// The returned function closes the agent connection once the client is connected
+func (r *SshRunner) authMethods() ([]ssh.AuthMethod, func(), error) {
+	var signers []ssh.Signer
+	signer, err := r.keySigner()
+	if err != nil {
+		return nil, nil, err
+	}
+	if signer != nil {
+		signers = append(signers, signer)
+	}
+
+	closeAgent := func() {}
+	if r.AgentSocket != "" {
+		conn, err := net.Dial("unix", r.AgentSocket)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't connect to ssh-agent: %w", err)
+		}
+		closeAgent = func() { conn.Close() }
+		agentSigners, err := agent.NewClient(conn).Signers()
+		if err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("couldn't list ssh-agent keys: %w", err)
+		}
+		signers = append(signers, agentSigners...)
+	}
+
+	if len(signers) == 0 {
+		closeAgent()
+		return nil, nil, errors.New("no SSH private key, certificate or agent keys available")
+	}
+	return []ssh.AuthMethod{ssh.PublicKeys(signers...)}, closeAgent, nil
+}
+
 func (r *SshRunner) makeClient() (*ssh.Client, error) {
-	verifier, err := knownhosts.New(r.KnownHosts)
+	verifier, algorithms, err := r.hostKeyCallback()
 	if err != nil {
 		return nil, err
 	}
 
-	signer, err := ssh.ParsePrivateKey([]byte(r.PrivateKey))
+	auth, closeAgent, err := r.authMethods()
 	if err != nil {
 		return nil, err
 	}
+	defer closeAgent()
 
 	config := &ssh.ClientConfig{
-		HostKeyCallback: verifier,
-		User:            r.User,
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback:   verifier,
+		HostKeyAlgorithms: algorithms,
+		User:              r.User,
+		Auth:              auth,
 	}
 
 	return ssh.Dial("tcp", r.Host, config)
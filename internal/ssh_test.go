@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestKey(t *testing.T) (ed25519.PrivateKey, ssh.Signer) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.Nil(t, err)
+	return key, signer
+}
+
+// newTestCertificate User certificate for key signed by a fresh CA, valid until validBefore
+func newTestCertificate(t *testing.T, key ssh.Signer, validBefore time.Time) string {
+	_, ca := newTestKey(t)
+	cert := &ssh.Certificate{
+		Key:             key.PublicKey(),
+		KeyId:           "libvirt-csi",
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"libvirt"},
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	assert.Nil(t, cert.SignCert(rand.Reader, ca))
+	return string(ssh.MarshalAuthorizedKey(cert))
+}
+
+func Test_KeySignerPassphrase(t *testing.T) {
+	key, _ := newTestKey(t)
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("secret"))
+	assert.Nil(t, err)
+	encrypted := string(pem.EncodeToMemory(block))
+
+	_, err = (&SshRunner{PrivateKey: encrypted}).keySigner()
+	assert.ErrorContains(t, err, "no passphrase")
+
+	signer, err := (&SshRunner{PrivateKey: encrypted, PrivateKeyPassphrase: "secret"}).keySigner()
+	assert.Nil(t, err)
+	assert.Equal(t, ssh.KeyAlgoED25519, signer.PublicKey().Type())
+}
+
+func Test_KeySignerCertificateFromFiles(t *testing.T) {
+	key, signer := newTestKey(t)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	assert.Nil(t, err)
+	dir := t.TempDir()
+	keyFile, certFile := filepath.Join(dir, "id_ed25519"), filepath.Join(dir, "id_ed25519-cert.pub")
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600))
+	assert.Nil(t, os.WriteFile(certFile, []byte(newTestCertificate(t, signer, time.Now().Add(time.Hour))), 0644))
+	runner := &SshRunner{PrivateKeyFile: keyFile, CertificateFile: certFile}
+
+	certSigner, err := runner.keySigner()
+	assert.Nil(t, err)
+	assert.Equal(t, ssh.CertAlgoED25519v01, certSigner.PublicKey().Type())
+
+	// Rotated files are picked up on the next connection
+	assert.Nil(t, os.WriteFile(certFile, []byte(newTestCertificate(t, signer, time.Now().Add(-time.Minute))), 0644))
+	_, err = runner.keySigner()
+	assert.ErrorContains(t, err, "expired")
+}
+
+func Test_HostKeyAlgorithms(t *testing.T) {
+	_, hostKey := newTestKey(t)
+	_, ca := newTestKey(t)
+	plain := "hypervisor " + string(ssh.MarshalAuthorizedKey(hostKey.PublicKey()))
+	authority := "@cert-authority *.example " + string(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+
+	assert.Equal(t, []string{ssh.KeyAlgoED25519}, hostKeyAlgorithms([]byte(plain)))
+	assert.Equal(t, append(append([]string{}, hostCertAlgorithms...), ssh.KeyAlgoED25519), hostKeyAlgorithms([]byte(authority+plain)))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/nijave/libvirt-csi/internal"
@@ -8,7 +9,11 @@ import (
 	"google.golang.org/grpc"
 	"k8s.io/klog/v2"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
 func mustGetEnv(name string) string {
@@ -21,23 +26,126 @@ func mustGetEnv(name string) string {
 
 func initController(grpcServer *grpc.Server) {
 	csiController := &pkg.LibvirtCsiController{
-		//SshHost:   mustGetEnv("SSH_HOST"),
-		CommandRunner: &internal.SshRunner{
-			Host:       mustGetEnv("SSH_HOST"),
-			User:       mustGetEnv("SSH_USER"),
-			KnownHosts: mustGetEnv("SSH_KNOWN_HOSTS"),
-			PrivateKey: mustGetEnv("SSH_PRIVATE_KEY"),
-		},
+		HelperMode: os.Getenv("HELPER_MODE"),
+	}
+
+	// Per-StorageClass credentials. Off by default since ListVolumes and GetCapacity can't cover those accounts and
+	// aren't advertised then
+	if sshSecrets := os.Getenv("SSH_SECRETS"); len(sshSecrets) > 0 {
+		enabled, err := strconv.ParseBool(sshSecrets)
+		if err != nil {
+			klog.Fatalf("SSH_SECRETS must be true or false, got %q", sshSecrets)
+		}
+		if enabled {
+			csiController.NewCommandRunner = func(credentials pkg.SshCredentials) pkg.RemoteSshRunner {
+				return &internal.SshRunner{
+					Host:                 credentials.Host,
+					User:                 credentials.User,
+					KnownHostsData:       credentials.KnownHosts,
+					PrivateKey:           credentials.PrivateKey,
+					PrivateKeyPassphrase: credentials.PrivateKeyPassphrase,
+					Certificate:          credentials.Certificate,
+				}
+			}
+		}
+	}
+
+	switch csiController.HelperMode {
+	case "", pkg.HelperModeSudo, pkg.HelperModeForcedCommand:
+	default:
+		klog.Fatalf("HELPER_MODE must be %s or %s, got %q", pkg.HelperModeSudo, pkg.HelperModeForcedCommand, csiController.HelperMode)
+	}
+
+	backends, err := pkg.ParseBackends(os.Getenv("STORAGE_BACKENDS"))
+	if err != nil {
+		klog.Fatalf("invalid STORAGE_BACKENDS: %s", err)
+	}
+	csiController.Backends = backends
+
+	// Default credentials for StorageClasses without SSH secrets. Optional if every StorageClass has them
+	if len(os.Getenv("SSH_HOST")) > 0 {
+		runner := &internal.SshRunner{
+			Host:                 mustGetEnv("SSH_HOST"),
+			User:                 mustGetEnv("SSH_USER"),
+			KnownHosts:           mustGetEnv("SSH_KNOWN_HOSTS"),
+			PrivateKey:           os.Getenv("SSH_PRIVATE_KEY"),
+			PrivateKeyFile:       os.Getenv("SSH_PRIVATE_KEY_FILE"),
+			PrivateKeyPassphrase: os.Getenv("SSH_PRIVATE_KEY_PASSPHRASE"),
+			CertificateFile:      os.Getenv("SSH_CERTIFICATE_FILE"),
+			AgentSocket:          os.Getenv("SSH_AUTH_SOCK"),
+		}
+		if runner.PrivateKey == "" && runner.PrivateKeyFile == "" && runner.AgentSocket == "" {
+			klog.Fatal("one of SSH_PRIVATE_KEY, SSH_PRIVATE_KEY_FILE or SSH_AUTH_SOCK has to be set")
+		}
+		csiController.CommandRunner = runner
+	} else {
+		if csiController.NewCommandRunner == nil {
+			klog.Fatal("SSH_HOST has to be set unless SSH_SECRETS is enabled")
+		}
+		klog.Info("SSH_HOST isn't set, StorageClasses need SSH secrets")
 	}
 
 	csi.RegisterControllerServer(grpcServer, csiController)
 	csi.RegisterIdentityServer(grpcServer, csiController)
 }
 
-func initDriver(grpcServer *grpc.Server) {
+// durationEnv Duration from an environment variable, zero if it isn't set
+func durationEnv(name string) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		klog.Fatalf("%s must be a duration like 24h, got %q", name, value)
+	}
+	return duration
+}
+
+func initDriver(grpcServer *grpc.Server, socket string) {
 	csiController := &pkg.LibvirtCsiController{}
 	csi.RegisterIdentityServer(grpcServer, csiController)
-	csiDriver := &pkg.LibvirtCsiDriver{}
+	csiDriver := &pkg.LibvirtCsiDriver{
+		NodeIdSource:  os.Getenv("NODE_ID_SOURCE"),
+		NodeName:      os.Getenv("KUBE_NODE_NAME"),
+		NodeIdMapFile: os.Getenv("NODE_ID_MAP"),
+	}
+	if maxVolumes := os.Getenv("MAX_VOLUMES_PER_NODE"); len(maxVolumes) > 0 {
+		limit, err := strconv.ParseInt(maxVolumes, 10, 64)
+		if err != nil || limit < 1 {
+			klog.Fatalf("MAX_VOLUMES_PER_NODE must be a positive number, got %q", maxVolumes)
+		}
+		csiDriver.MaxVolumesPerNode = limit
+	}
+	attachBus, err := pkg.ParseAttachBus(os.Getenv("ATTACH_BUS"))
+	if err != nil {
+		klog.Fatalf("invalid ATTACH_BUS: %s", err)
+	}
+	csiDriver.AttachBus = attachBus
+	if disks := os.Getenv("DISKS_PER_SCSI_CONTROLLER"); len(disks) > 0 {
+		limit, err := strconv.ParseInt(disks, 10, 64)
+		if err != nil || limit < 1 {
+			klog.Fatalf("DISKS_PER_SCSI_CONTROLLER must be a positive number, got %q", disks)
+		}
+		csiDriver.DisksPerScsiController = limit
+	}
+
+	// The socket is in the plugin's host directory, so the registry survives restarts
+	csiDriver.PublishedVolumesFile = filepath.Join(filepath.Dir(socket), "published-volumes.json")
+	csiDriver.UsedVolumesFile = filepath.Join(filepath.Dir(socket), "used-volumes.json")
+	if mountDiscard := os.Getenv("MOUNT_DISCARD"); len(mountDiscard) > 0 {
+		enabled, err := strconv.ParseBool(mountDiscard)
+		if err != nil {
+			klog.Fatalf("MOUNT_DISCARD must be true or false, got %q", mountDiscard)
+		}
+		csiDriver.MountDiscard = enabled
+	}
+	csiDriver.FstrimInterval = durationEnv("FSTRIM_INTERVAL")
+	csiDriver.FstrimJitter = durationEnv("FSTRIM_JITTER")
+	if csiDriver.FstrimInterval > 0 {
+		go csiDriver.RunPeriodicTrim(context.Background())
+	}
+
 	csi.RegisterNodeServer(grpcServer, csiDriver)
 }
 
@@ -69,12 +177,19 @@ func main() {
 	case "controller":
 		initController(grpcServer)
 	case "driver":
-		initDriver(grpcServer)
+		initDriver(grpcServer, socket)
 	default:
 		listen.Close()
 		klog.Fatal("invalid grpc-service specified")
 	}
 
+	// expvar metrics on /debug/vars
+	if metricsAddress := os.Getenv("METRICS_ADDRESS"); len(metricsAddress) > 0 {
+		go func() {
+			klog.Fatal(http.ListenAndServe(metricsAddress, nil))
+		}()
+	}
+
 	klog.Infof("server %s listening at %v", grpcService, listen.Addr())
 	if err := grpcServer.Serve(listen); err != nil {
 		klog.Fatalf("failed to serve: %v", err)
@@ -0,0 +1,232 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Storage backends a StorageClass can pick with the backend parameter
+const backendLvm = "lvm" // Logical volumes in a volume group, optionally thin (default)
+const backendDir = "dir" // qcow2 or raw image files in a directory
+const backendZfs = "zfs" // zvols under a dataset
+const backendRbd = "rbd" // Ceph RBD images in a pool
+
+// Image formats of the dir backend
+const imageFormatQcow2 = "qcow2"
+const imageFormatRaw = "raw"
+
+// Separates the backend from the helper's volume id in volume ids of backends other than LVM. LVM volume ids have no
+// prefix so volumes created before there were backends keep working
+const volumeIdSeparator = ":"
+
+// Returned by storageBackend.delete if the volume doesn't exist
+var errVolumeNotFound = errors.New("volume not found")
+
+// storageBackend Volume operations of one storage pool type. Volume ids passed in and returned are the helper's,
+// without the backend prefix
+type storageBackend interface {
+	// validateParameters Check the StorageClass parameters that depend on the backend
+	validateParameters(parameters *volumeParameters) error
+	create(helper *helperClient, parameters *volumeParameters, size int64) (createdVolume, error)
+	// delete Returns errVolumeNotFound if there's no such volume
+	delete(helper *helperClient, pvId string) error
+	list(helper *helperClient) ([]VolumeInfo, error)
+	capacity(helper *helperClient, parameters *volumeParameters) (*poolCapacity, error)
+}
+
+var storageBackends = map[string]storageBackend{
+	backendLvm: &lvmBackend{helperBackend{backendLvm, regexp.MustCompile(`Failed to find logical volume`)}},
+	backendDir: &dirBackend{helperBackend{backendDir, regexp.MustCompile(`Storage volume not found|No such file or directory`)}},
+	backendZfs: &zfsBackend{helperBackend{backendZfs, regexp.MustCompile(`dataset does not exist`)}},
+	backendRbd: &rbdBackend{helperBackend{backendRbd, regexp.MustCompile(`\(2\) No such file or directory|image not found`)}},
+}
+
+// ParseBackends Parse a comma separated list of backend names
+func ParseBackends(value string) ([]string, error) {
+	var backends []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := storageBackends[name]; !ok {
+			return nil, fmt.Errorf("unknown backend %q", name)
+		}
+		backends = append(backends, name)
+	}
+	return backends, nil
+}
+
+// formatVolumeId CSI volume id of a helper volume id
+func formatVolumeId(backend string, pvId string) string {
+	if backend == backendLvm {
+		return pvId
+	}
+	return backend + volumeIdSeparator + pvId
+}
+
+// splitVolumeId Backend and helper volume id of a CSI volume id
+func splitVolumeId(volumeId string) (string, string) {
+	if backend, pvId, ok := strings.Cut(volumeId, volumeIdSeparator); ok {
+		return backend, pvId
+	}
+	return backendLvm, volumeId
+}
+
+// volumeBackend The backend of a CSI volume id and the helper's id for the volume
+func volumeBackend(volumeId string) (storageBackend, string, error) {
+	name, pvId := splitVolumeId(volumeId)
+	backend, ok := storageBackends[name]
+	if !ok {
+		return nil, "", fmt.Errorf("volume %s has unknown backend %q", volumeId, name)
+	}
+	return backend, pvId, nil
+}
+
+// newVolumeRequest Helper request for an operation on an existing volume, addressed to its backend
+func newVolumeRequest(operation string, volumeId string) *HelperRequest {
+	name, pvId := splitVolumeId(volumeId)
+	return &HelperRequest{Operation: operation, Backend: helperBackendName(name), VolumeId: pvId}
+}
+
+// helperBackendName Backend as sent to the helper. LVM is left out for helpers that predate backends
+func helperBackendName(backend string) string {
+	if backend == backendLvm {
+		return ""
+	}
+	return backend
+}
+
+// helperBackend Runs the operations through libvirt-storage-attach, which does the backend specific work
+type helperBackend struct {
+	name string
+	// Helper stderr meaning the volume doesn't exist
+	notFound *regexp.Regexp
+}
+
+func (b *helperBackend) create(helper *helperClient, parameters *volumeParameters, size int64) (createdVolume, error) {
+	request := &HelperRequest{
+		Operation:   helperOperationCreate,
+		Backend:     helperBackendName(b.name),
+		VolumeGroup: parameters.VolumeGroup,
+		ThinPool:    parameters.ThinPool,
+		Pool:        parameters.Pool,
+		ImageFormat: parameters.ImageFormat,
+		Size:        size,
+		Shareable:   parameters.MultiAttach,
+	}
+	// Stored on the volume so ControllerModifyVolume can check changes against them, see VolumeInfo.Attributes. Only
+	// what the StorageClass sets is sent, helpers that don't store settings yet keep working for StorageClasses without
+	// tuning. The discard default is left out too, parseDiskTuning applies it again
+	tuning := parameters.Tuning
+	if tuning.Discard == defaultDiscard {
+		tuning.Discard = ""
+	}
+	tuning.apply(request)
+	stdout, stderr, err := helper.run(request)
+	if err != nil {
+		return createdVolume{}, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr))
+	}
+	created, ok := parseCreatedVolume(stdout)
+	if !ok {
+		return created, fmt.Errorf("invalid volume id %q", created.Id)
+	}
+	return created, nil
+}
+
+func (b *helperBackend) delete(helper *helperClient, pvId string) error {
+	_, stderr, err := helper.run(&HelperRequest{Operation: helperOperationDelete, Backend: helperBackendName(b.name), VolumeId: pvId})
+	if err != nil && b.notFound.MatchString(stderr) {
+		return errVolumeNotFound
+	}
+	return err
+}
+
+func (b *helperBackend) list(helper *helperClient) ([]VolumeInfo, error) {
+	stdout, _, err := helper.run(&HelperRequest{Operation: helperOperationList, Backend: helperBackendName(b.name)})
+	if err != nil {
+		return nil, err
+	}
+	var volumes []VolumeInfo
+	if err := json.Unmarshal([]byte(stdout), &volumes); err != nil {
+		return nil, err
+	}
+	for i := range volumes {
+		volumes[i].Id = formatVolumeId(b.name, volumes[i].Id)
+	}
+	return volumes, nil
+}
+
+func (b *helperBackend) capacity(helper *helperClient, parameters *volumeParameters) (*poolCapacity, error) {
+	return getPoolCapacity(helper, &HelperRequest{
+		Operation:   helperOperationCapacity,
+		Backend:     helperBackendName(b.name),
+		VolumeGroup: parameters.VolumeGroup,
+		ThinPool:    parameters.ThinPool,
+		Pool:        parameters.Pool,
+	})
+}
+
+// requirePool Check the pool parameter of the backends other than LVM, which don't take LVM's parameters
+func (b *helperBackend) requirePool(parameters *volumeParameters, poolRegex *regexp.Regexp) error {
+	if parameters.VolumeGroup != "" || parameters.ThinPool != "" {
+		return fmt.Errorf("%s volumes don't take %s or %s, use %s", b.name, parameterVolumeGroup, parameterThinPool, parameterPool)
+	}
+	if parameters.Pool == "" {
+		return fmt.Errorf("%s volumes require %s", b.name, parameterPool)
+	}
+	if !poolRegex.MatchString(parameters.Pool) || strings.Contains(parameters.Pool, "..") {
+		return fmt.Errorf("invalid %s %s %q", b.name, parameterPool, parameters.Pool)
+	}
+	if parameters.ImageFormat != "" && b.name != backendDir {
+		return fmt.Errorf("%s volumes don't take %s", b.name, parameterImageFormat)
+	}
+	return nil
+}
+
+// lvmBackend Thick or thin logical volumes, see volumeGroup and thinPool
+type lvmBackend struct{ helperBackend }
+
+func (b *lvmBackend) validateParameters(parameters *volumeParameters) error {
+	if parameters.Pool != "" || parameters.ImageFormat != "" {
+		return fmt.Errorf("lvm volumes don't take %s or %s, use %s", parameterPool, parameterImageFormat, parameterVolumeGroup)
+	}
+	return nil
+}
+
+// dirBackend Image files in the directory named by pool, like a libvirt dir pool
+type dirBackend struct{ helperBackend }
+
+var dirPoolRegex = regexp.MustCompile(`^(/[A-Za-z0-9+_.-]+)+$`)
+
+func (b *dirBackend) validateParameters(parameters *volumeParameters) error {
+	if err := b.requirePool(parameters, dirPoolRegex); err != nil {
+		return err
+	}
+	switch parameters.ImageFormat {
+	case "", imageFormatQcow2, imageFormatRaw:
+		return nil
+	}
+	return fmt.Errorf("invalid %s %q, must be %s or %s", parameterImageFormat, parameters.ImageFormat, imageFormatQcow2, imageFormatRaw)
+}
+
+// zfsBackend zvols under the dataset named by pool
+type zfsBackend struct{ helperBackend }
+
+var zfsPoolRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.:-]*(/[A-Za-z0-9_.:-]+)*$`)
+
+func (b *zfsBackend) validateParameters(parameters *volumeParameters) error {
+	return b.requirePool(parameters, zfsPoolRegex)
+}
+
+// rbdBackend Images in the Ceph pool named by pool. The hypervisor needs a Ceph client config and keyring for it
+type rbdBackend struct{ helperBackend }
+
+var rbdPoolRegex = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+func (b *rbdBackend) validateParameters(parameters *volumeParameters) error {
+	return b.requirePool(parameters, rbdPoolRegex)
+}
@@ -0,0 +1,129 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_SplitVolumeId(t *testing.T) {
+	backend, pvId := splitVolumeId(testVolumeId)
+	assert.Equal(t, backendLvm, backend)
+	assert.Equal(t, testVolumeId, pvId)
+
+	backend, pvId = splitVolumeId(formatVolumeId(backendZfs, testVolumeId))
+	assert.Equal(t, backendZfs, backend)
+	assert.Equal(t, testVolumeId, pvId)
+
+	assert.Equal(t, volumeSerial(testVolumeId), volumeSerial("rbd:"+testVolumeId))
+}
+
+func Test_BackendParameters(t *testing.T) {
+	valid := []map[string]string{
+		{parameterBackend: backendDir, parameterPool: "/var/lib/libvirt/images", parameterImageFormat: "raw"},
+		{parameterBackend: backendZfs, parameterPool: "tank/libvirt-csi"},
+		{parameterBackend: backendRbd, parameterPool: "kube"},
+		{parameterBackend: backendLvm, parameterVolumeGroup: "vg0"},
+	}
+	for _, parameters := range valid {
+		_, err := parseVolumeParameters(parameters)
+		assert.Nil(t, err, parameters)
+	}
+
+	invalid := []map[string]string{
+		{parameterBackend: "nfs"},
+		{parameterBackend: backendDir},
+		{parameterBackend: backendDir, parameterPool: "images"},
+		{parameterBackend: backendDir, parameterPool: "/var/lib/../../etc"},
+		{parameterBackend: backendDir, parameterPool: "/images", parameterImageFormat: "vmdk"},
+		{parameterBackend: backendZfs, parameterPool: "/tank"},
+		{parameterBackend: backendZfs, parameterPool: "tank", parameterImageFormat: "raw"},
+		{parameterBackend: backendRbd, parameterPool: "kube", parameterVolumeGroup: "vg0"},
+		{parameterBackend: backendRbd, parameterPool: "kube", parameterThinPool: "thinpool"},
+		{parameterPool: "tank"},
+	}
+	for _, parameters := range invalid {
+		_, err := parseVolumeParameters(parameters)
+		assert.NotNil(t, err, parameters)
+	}
+}
+
+func Test_ParseBackends(t *testing.T) {
+	backends, err := ParseBackends("lvm, zfs,")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{backendLvm, backendZfs}, backends)
+
+	backends, err = ParseBackends("")
+	assert.Nil(t, err)
+	assert.Nil(t, backends)
+
+	_, err = ParseBackends("lvm,nfs")
+	assert.NotNil(t, err)
+}
+
+func Test_CreateVolumeBackend(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Stdout = testVolumeId
+
+	response, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		Parameters:         map[string]string{parameterBackend: backendDir, parameterPool: "/var/lib/libvirt/images"},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "dir:"+testVolumeId, response.Volume.VolumeId)
+	assert.Equal(t, "sudo libvirt-storage-attach -operation=create -backend=dir -pool=/var/lib/libvirt/images -size=1073741824", mockSsh.Commands[0])
+}
+
+func Test_DeleteVolumeBackendNotFound(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Error = assert.AnError
+	mockSsh.Stderr = "cannot open 'tank/libvirt-csi/" + testVolumeId + "': dataset does not exist"
+
+	_, err := controller.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "zfs:" + testVolumeId})
+
+	assert.ErrorIs(t, err, errVolumeNotFound)
+	assert.Equal(t, "sudo libvirt-storage-attach -operation=delete -backend=zfs -pv-id="+testVolumeId, mockSsh.Commands[0])
+}
+
+func Test_PublishVolumeBackend(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": `[{"Id":"` + testVolumeId + `","Owners":[]}]`}
+
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "rbd:" + testVolumeId,
+		NodeId:           "node-1",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "sudo libvirt-storage-attach -operation=list -backend=rbd", mockSsh.Commands[0])
+	assert.Equal(t, "sudo libvirt-storage-attach -operation=attach -backend=rbd -pv-id="+testVolumeId+" -vm-name=node-1 -discard=unmap", mockSsh.Commands[1])
+}
+
+func Test_ListVolumesBackends(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Stdout = testListOutput
+	controller.Backends = []string{backendLvm, backendZfs}
+
+	response, err := controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+
+	assert.Nil(t, err)
+	assert.Len(t, response.Entries, 2)
+	assert.Equal(t, "zfs:pv-a61a74d2-ab75-458b-bf1b-0216923ca686", response.Entries[1].Volume.VolumeId)
+}
+
+func Test_HelperRequestBackend(t *testing.T) {
+	request := HelperRequest{Operation: helperOperationDelete, Backend: backendRbd, VolumeId: testVolumeId}
+	assert.Nil(t, request.Validate())
+	encoded, _ := json.Marshal(request)
+	assert.Contains(t, string(encoded), `"backend":"rbd"`)
+
+	assert.NotNil(t, (&HelperRequest{Operation: helperOperationList, Backend: "nfs"}).Validate())
+	assert.NotNil(t, (&HelperRequest{Operation: helperOperationCreate, Pool: "/images/../etc", Size: 1}).Validate())
+	assert.NotNil(t, (&HelperRequest{Operation: "resize", VolumeId: testVolumeId, Size: 1}).Validate())
+}
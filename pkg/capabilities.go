@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// Access modes volumes can be created with. SINGLE_NODE_SINGLE_WRITER (ReadWriteOncePod) is enforced by the CO,
+// to libvirt it's the same single-domain attachment as the other single node modes
+var supportedAccessModes = map[csi.VolumeCapability_AccessMode_Mode]struct{}{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:        {},
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:   {},
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER: {},
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:  {},
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:    {},
+}
+
+// validateCapability Check an access mode and type combination. Volumes created for multi-attach are shared raw
+// disks and can only be used as block devices since regular filesystems would be corrupted by concurrent mounts
+func validateCapability(capability *csi.VolumeCapability, multiAttach bool) error {
+	if capability.GetAccessMode() == nil {
+		return errors.New("access mode is required")
+	}
+	mode := capability.GetAccessMode().GetMode()
+
+	if capability.GetBlock() == nil && capability.GetMount() == nil {
+		return fmt.Errorf("access type is required for access mode %s", mode)
+	}
+
+	if multiAttach {
+		if capability.GetBlock() == nil {
+			return fmt.Errorf("%s volumes only support block access, not filesystem access", parameterMultiAttach)
+		}
+		if mode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER {
+			return nil
+		}
+	} else if mode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER {
+		return fmt.Errorf("access mode %s requires block access and the %s parameter", mode, parameterMultiAttach)
+	}
+
+	if _, ok := supportedAccessModes[mode]; !ok {
+		return fmt.Errorf("access mode %s isn't supported", mode)
+	}
+	return nil
+}
+
+// validateCapabilities Check every requested capability, reporting the first unsupported one
+func validateCapabilities(capabilities []*csi.VolumeCapability, multiAttach bool) error {
+	for i, capability := range capabilities {
+		if err := validateCapability(capability, multiAttach); err != nil {
+			return fmt.Errorf("volume capability %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func isReadOnlyMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
+func isMultiNodeMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		return true
+	default:
+		return false
+	}
+}
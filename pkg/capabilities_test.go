@@ -0,0 +1,49 @@
+package pkg
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func mountCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	}
+}
+
+func Test_ValidateCapabilitiesSingleNodeModes(t *testing.T) {
+	err := validateCapabilities([]*csi.VolumeCapability{
+		mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER),
+		mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER),
+	}, false)
+
+	assert.Nil(t, err)
+}
+
+func Test_ValidateCapabilitiesChecksEveryCapability(t *testing.T) {
+	err := validateCapabilities([]*csi.VolumeCapability{
+		mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER),
+	}, false)
+
+	assert.EqualError(t, err, "volume capability 1: access mode MULTI_NODE_SINGLE_WRITER isn't supported")
+}
+
+func Test_ValidateCapabilitiesMultiWriterNeedsMultiAttach(t *testing.T) {
+	err := validateCapabilities([]*csi.VolumeCapability{
+		mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+	}, false)
+
+	assert.EqualError(t, err, "volume capability 0: access mode MULTI_NODE_MULTI_WRITER requires block access and the multiAttach parameter")
+}
+
+func Test_ValidateCapabilitiesMissingAccessType(t *testing.T) {
+	err := validateCapabilities([]*csi.VolumeCapability{{
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}}, false)
+
+	assert.EqualError(t, err, "volume capability 0: access type is required for access mode SINGLE_NODE_WRITER")
+}
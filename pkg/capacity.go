@@ -0,0 +1,61 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// createdVolume What libvirt-storage-attach reports after creating a volume. Older versions only print the id
+type createdVolume struct {
+	Id       string
+	Capacity int64 // Bytes actually allocated, 0 if not reported
+}
+
+// roundUp Round size up to a multiple of granularity
+func roundUp(size int64, granularity int64) int64 {
+	return (size + granularity - 1) / granularity * granularity
+}
+
+// volumeCapacity Size to create a volume with, a multiple of granularity within the requested range. Without a
+// required size the default is used, rounded down to fit under the limit
+func volumeCapacity(capacityRange *csi.CapacityRange, granularity int64) (int64, error) {
+	required := capacityRange.GetRequiredBytes()
+	limit := capacityRange.GetLimitBytes()
+	if required < 0 || limit < 0 {
+		return 0, status.Error(codes.InvalidArgument, "capacity range can't be negative")
+	}
+	if limit > 0 && required > limit {
+		return 0, status.Error(codes.InvalidArgument, fmt.Sprintf("required bytes %d exceed limit bytes %d", required, limit))
+	}
+
+	if required == 0 {
+		capacity := roundUp(int64(defaultCapacity)*1024*1024*1024, granularity)
+		if limit > 0 && capacity > limit {
+			// Round down, anything up to the limit will do
+			capacity = limit / granularity * granularity
+			if capacity == 0 {
+				return 0, status.Error(codes.OutOfRange, fmt.Sprintf("limit bytes %d are less than the allocation size %d", limit, granularity))
+			}
+		}
+		return capacity, nil
+	}
+
+	capacity := roundUp(required, granularity)
+	if limit > 0 && capacity > limit {
+		return 0, status.Error(codes.OutOfRange, fmt.Sprintf("required bytes %d rounded up to the allocation size %d are %d, more than limit bytes %d", required, granularity, capacity, limit))
+	}
+	return capacity, nil
+}
+
+// parseCreatedVolume Parse create output, either JSON or just the volume id
+func parseCreatedVolume(stdout string) (createdVolume, bool) {
+	var volume createdVolume
+	if err := json.Unmarshal([]byte(stdout), &volume); err != nil {
+		volume = createdVolume{Id: strings.TrimSpace(stdout)}
+	}
+	return volume, helperVolumeIdRegex.MatchString(volume.Id)
+}
@@ -0,0 +1,110 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func Test_VolumeCapacity(t *testing.T) {
+	const granularity = 4 << 20
+	for _, test := range []struct {
+		capacityRange *csi.CapacityRange
+		capacity      int64
+	}{
+		{nil, defaultCapacity << 30},
+		{&csi.CapacityRange{}, defaultCapacity << 30},
+		{&csi.CapacityRange{RequiredBytes: 1 << 30}, 1 << 30},
+		{&csi.CapacityRange{RequiredBytes: 1000}, granularity},
+		{&csi.CapacityRange{RequiredBytes: (1 << 30) + 1}, (1 << 30) + granularity},
+		{&csi.CapacityRange{RequiredBytes: 1000, LimitBytes: granularity}, granularity},
+		{&csi.CapacityRange{LimitBytes: (1 << 30) + 1000}, 1 << 30},
+	} {
+		capacity, err := volumeCapacity(test.capacityRange, granularity)
+		assert.Nil(t, err, test.capacityRange)
+		assert.Equal(t, test.capacity, capacity, test.capacityRange)
+	}
+}
+
+func Test_VolumeCapacityDefaultGranularity(t *testing.T) {
+	for _, test := range []struct {
+		capacityRange *csi.CapacityRange
+		granularity   int64
+		capacity      int64
+	}{
+		{nil, 8 << 30, 24 << 30},
+		{nil, 64 << 30, 64 << 30},
+		{&csi.CapacityRange{LimitBytes: 30 << 30}, 8 << 30, 24 << 30},
+		// The default rounded up doesn't fit, anything up to the limit will do
+		{&csi.CapacityRange{LimitBytes: 100 << 30}, 64 << 30, 64 << 30},
+		{&csi.CapacityRange{LimitBytes: 22 << 30}, 8 << 30, 16 << 30},
+	} {
+		capacity, err := volumeCapacity(test.capacityRange, test.granularity)
+		assert.Nil(t, err, test.capacityRange)
+		assert.Equal(t, test.capacity, capacity, test.capacityRange)
+	}
+
+	_, err := volumeCapacity(&csi.CapacityRange{LimitBytes: 30 << 30}, 64<<30)
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+func Test_VolumeCapacityInvalid(t *testing.T) {
+	const granularity = 4 << 20
+	_, err := volumeCapacity(&csi.CapacityRange{RequiredBytes: 1000, LimitBytes: 2000}, granularity)
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+
+	_, err = volumeCapacity(&csi.CapacityRange{LimitBytes: 1 << 20}, granularity)
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+
+	_, err = volumeCapacity(&csi.CapacityRange{RequiredBytes: 2 << 30, LimitBytes: 1 << 30}, granularity)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = volumeCapacity(&csi.CapacityRange{RequiredBytes: -1}, granularity)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func Test_ParseCreatedVolume(t *testing.T) {
+	volume, ok := parseCreatedVolume(testVolumeId + "\n")
+	assert.True(t, ok)
+	assert.Equal(t, createdVolume{Id: testVolumeId}, volume)
+
+	volume, ok = parseCreatedVolume(`{"Id":"` + testVolumeId + `","Capacity":1077936128}`)
+	assert.True(t, ok)
+	assert.Equal(t, createdVolume{Id: testVolumeId, Capacity: 1077936128}, volume)
+
+	_, ok = parseCreatedVolume("  Volume group \"vg0\" has insufficient free space")
+	assert.False(t, ok)
+}
+
+func Test_CreateVolumeCapacity(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"create": `{"Id":"` + testVolumeId + `","Capacity":1082130432}`}
+
+	response, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: (1 << 30) + 1},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+
+	assert.Nil(t, err)
+	assert.Contains(t, mockSsh.Commands[0], " -size=1077936128")
+	assert.Equal(t, int64(1082130432), response.Volume.CapacityBytes)
+}
+
+func Test_CreateVolumeCapacityOverLimit(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"create": `{"Id":"` + testVolumeId + `","Capacity":1082130432}`}
+
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30, LimitBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+	assert.Contains(t, mockSsh.Commands[0], " -size=1073741824")
+	assert.True(t, mockSsh.ranOperation("delete"))
+}
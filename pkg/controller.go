@@ -5,28 +5,44 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/alessio/shellescape"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 	"k8s.io/klog/v2"
+	"sort"
 	"strings"
+	"sync"
 )
 
-type remoteSshRunner interface {
-	RunCommand(string) (string, string, error)
+// RemoteSshRunner Runs a command on the hypervisor, feeding it stdin if it isn't nil
+type RemoteSshRunner interface {
+	RunCommand(command string, stdin []byte) (string, string, error)
 }
 
 type LibvirtCsiController struct {
 	csi.IdentityServer
 	csi.ControllerServer
-	CommandRunner remoteSshRunner
+	CommandRunner RemoteSshRunner // Used when the StorageClass doesn't configure SSH secrets, may be nil
+
+	// One of the HelperMode constants
+	HelperMode string
+
+	// Backends ListVolumes covers, only lvm if empty
+	Backends []string
+
+	// Creates runners for the SSH credentials in CSI secrets, see helperFor. Secrets are rejected if it's nil
+	NewCommandRunner func(SshCredentials) RemoteSshRunner
+	runnerLock       sync.Mutex
+	runners          map[string]*cachedRunner
 }
 
 const driverName = "libvirt-csi.nijave.github.com"
 const driverVersion = "1.0.0"
-const defaultCapacity = 20 // GB
+const defaultCapacity = 20 // GiB
+
+// StorageClass parameter allowing a block volume to be attached to several domains at once
+const parameterMultiAttach = "multiAttach"
 
 type ExecResult struct {
 	ExitCode int
@@ -35,9 +51,99 @@ type ExecResult struct {
 }
 
 type VolumeInfo struct {
-	Id       string
-	Capacity int64
-	Owners   []string
+	Id          string
+	Capacity    int64
+	Owners      []string              // Domain names
+	OwnerUuids  map[string]string     // Domain UUID per owner, if libvirt-storage-attach reports it
+	Attachments map[string]AttachInfo // Disk per owner, if libvirt-storage-attach reports it
+	// Settings stored on the volume by StorageClass parameter name: the tuning and multiAttach ("true" or "false")
+	// from CreateVolume, with the tuning updated by ControllerModifyVolume. Defaults aren't stored. Volumes created by
+	// helpers that didn't store them only have what ControllerModifyVolume set, if anything
+	Attributes map[string]string
+	// Whether the volume was ever attached. libvirt-storage-attach marks volumes on their first attach and the mark
+	// stays until they're deleted. Nil if the helper doesn't report it, such volumes are never considered fresh
+	Used *bool
+}
+
+// isFresh Whether the volume was never attached, so anything on it is left over from whatever previously used the
+// space
+func (v *VolumeInfo) isFresh() bool {
+	return v.Used != nil && !*v.Used
+}
+
+// ownerFor The owner a NodeId refers to, matching either the domain name or its UUID
+func (v *VolumeInfo) ownerFor(nodeId string) (string, bool) {
+	for _, owner := range v.Owners {
+		if owner == nodeId || (isDomainUuid(nodeId) && strings.EqualFold(v.OwnerUuids[owner], nodeId)) {
+			return owner, true
+		}
+	}
+	return "", false
+}
+
+// ambiguousOwners Owners a UUID NodeId could refer to because the helper didn't report their UUID
+func (v *VolumeInfo) ambiguousOwners(nodeId string) []string {
+	if !isDomainUuid(nodeId) {
+		return nil
+	}
+	var owners []string
+	for _, owner := range v.Owners {
+		if v.OwnerUuids[owner] == "" {
+			owners = append(owners, owner)
+		}
+	}
+	return owners
+}
+
+// publishedNodeIds NodeIds the volume is published to. Nodes may identify themselves by domain name or UUID, so
+// both are reported
+func (v *VolumeInfo) publishedNodeIds() []string {
+	nodeIds := append([]string{}, v.Owners...)
+	for _, owner := range v.Owners {
+		if uuid := v.OwnerUuids[owner]; uuid != "" {
+			nodeIds = append(nodeIds, uuid)
+		}
+	}
+	return nodeIds
+}
+
+// ownerDomain The domain UUID of an owner if it's known, its name otherwise
+func (v *VolumeInfo) ownerDomain(owner string) string {
+	if uuid := v.OwnerUuids[owner]; uuid != "" {
+		return uuid
+	}
+	return owner
+}
+
+// Keys of the PublishContext ControllerPublishVolume hands to the node
+const publishContextTarget = "target"
+const publishContextBus = "bus"
+const publishContextWwn = "wwn"
+const publishContextSerial = "serial"
+const publishContextFresh = "fresh" // Set on the first attach of a volume, see VolumeInfo.Used
+
+// AttachInfo Disk libvirt-storage-attach attached a volume as
+type AttachInfo struct {
+	Target   string // libvirt target dev, e.g. sdb or vdb. The guest kernel may name the disk differently
+	Bus      string // scsi, virtio or nvme
+	Wwn      string
+	Serial   string
+	ReadOnly bool
+}
+
+func (a *AttachInfo) publishContext() map[string]string {
+	publishContext := map[string]string{}
+	for key, value := range map[string]string{
+		publishContextTarget: a.Target,
+		publishContextBus:    a.Bus,
+		publishContextWwn:    a.Wwn,
+		publishContextSerial: a.Serial,
+	} {
+		if value != "" {
+			publishContext[key] = value
+		}
+	}
+	return publishContext
 }
 
 // IdentityServer
@@ -73,20 +179,59 @@ func (s *LibvirtCsiController) GetPluginCapabilities(ctx context.Context, reques
 
 // ControllerServer
 
-func (s *LibvirtCsiController) ListVolumes(ctx context.Context, request *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	logRequest("listing volumes", request)
+// listVolumes Volumes of every backend, with CSI volume ids
+func listVolumes(helper *helperClient, backends []string) ([]VolumeInfo, error) {
+	if len(backends) == 0 {
+		backends = []string{backendLvm}
+	}
 
 	var volumeInfo []VolumeInfo
-	stdout, stderr, err := s.CommandRunner.RunCommand(fmt.Sprintf(
-		"sudo libvirt-storage-attach -operation=list",
-	))
+	for _, name := range backends {
+		backend, ok := storageBackends[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown backend %q", name)
+		}
+		volumes, err := backend.list(helper)
+		if err != nil {
+			return nil, err
+		}
+		volumeInfo = append(volumeInfo, volumes...)
+	}
+
+	return volumeInfo, nil
+}
 
+// getVolume Look up a single volume and the domains it's attached to. Returns nil if the volume doesn't exist
+func getVolume(helper *helperClient, volumeId string) (*VolumeInfo, error) {
+	backend, _, err := volumeBackend(volumeId)
+	if err != nil {
+		// Nothing by that id can exist
+		klog.InfoS("not a volume id of any backend", "pv-id", volumeId, "err", err.Error())
+		return nil, nil
+	}
+	volumes, err := backend.list(helper)
 	if err != nil {
-		klog.InfoS("error running libvirt-storage-attach", "operation", "list", "stdout", stdout, "stderr", stderr, "err", err.Error())
 		return nil, err
 	}
 
-	err = json.Unmarshal([]byte(stdout), &volumeInfo)
+	for _, volume := range volumes {
+		if volume.Id == volumeId {
+			return &volume, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *LibvirtCsiController) ListVolumes(ctx context.Context, request *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	logRequest("listing volumes", request)
+
+	// There are no secrets to pick another account with, so this only lists the default hypervisor's volumes. The
+	// capability isn't advertised if secrets are enabled
+	helper, err := s.helperFor(nil)
+	if err != nil {
+		return nil, err
+	}
+	volumeInfo, err := listVolumes(helper, s.Backends)
 	if err != nil {
 		return nil, err
 	}
@@ -102,8 +247,8 @@ func (s *LibvirtCsiController) ListVolumes(ctx context.Context, request *csi.Lis
 				AccessibleTopology: nil,
 			},
 			Status: &csi.ListVolumesResponse_VolumeStatus{
-				PublishedNodeIds: volume.Owners, // OPTIONAL
-				VolumeCondition:  nil,           // OPTIONAL
+				PublishedNodeIds: volume.publishedNodeIds(), // OPTIONAL
+				VolumeCondition:  nil,                       // OPTIONAL
 			},
 		})
 	}
@@ -117,66 +262,88 @@ func (s *LibvirtCsiController) ListVolumes(ctx context.Context, request *csi.Lis
 func (s *LibvirtCsiController) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	logRequest("creating volume", request)
 
-	volumeGroup := ""
-	if vg, ok := request.Parameters["volumeGroup"]; ok {
-		volumeGroup = vg
+	helper, err := s.helperFor(request.Secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	parameters, err := parseVolumeParameters(request.Parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
 	response := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      "",
-			CapacityBytes: 0,
-			VolumeContext: map[string]string{
-				"volumeGroup": volumeGroup,
-			},
+			VolumeId:           "",
+			CapacityBytes:      0,
+			VolumeContext:      parameters.volumeContext(),
 			ContentSource:      nil,
 			AccessibleTopology: nil,
 		},
 	}
 
-	if len(request.VolumeCapabilities) > 0 {
-		if request.VolumeCapabilities[0].AccessMode.GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
-			capabilities := make([]string, len(request.VolumeCapabilities))
-			for _, capability := range request.VolumeCapabilities {
-				capabilities = append(capabilities, capability.String())
-			}
-			klog.InfoS("unsupported capabilities", "capabilities", strings.Join(capabilities, ","))
-			return response, status.Error(codes.InvalidArgument, "")
-		}
+	if len(request.VolumeCapabilities) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities are required")
+	}
+	if err := validateCapabilities(request.VolumeCapabilities, parameters.MultiAttach); err != nil {
+		klog.InfoS("unsupported capabilities", "capabilities", request.VolumeCapabilities, "err", err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	var capacity int64
-	capacity = defaultCapacity * 1024 * 1024 * 1024
-	if request.CapacityRange != nil {
-		if request.CapacityRange.LimitBytes > 0 {
-			capacity = request.CapacityRange.LimitBytes
+	// Filesystem options are validated against the filesystem the first mount capability asks for
+	for _, capability := range request.VolumeCapabilities {
+		if capability.GetMount() == nil {
+			continue
+		}
+		fsOptions, err := parseFilesystemOptions(capabilityFilesystem(capability, request.Parameters), request.Parameters)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
 		}
-		if request.CapacityRange.RequiredBytes > 0 {
-			capacity = request.CapacityRange.RequiredBytes
+		for key, value := range fsOptions.volumeContext() {
+			response.Volume.VolumeContext[key] = value
 		}
+		break
 	}
 
-	response.Volume.CapacityBytes = capacity
+	capacity, err := volumeCapacity(request.CapacityRange, parameters.SizeGranularity)
+	if err != nil {
+		return nil, err
+	}
 
-	createPvCommand := fmt.Sprintf(
-		"sudo libvirt-storage-attach -operation=create -volume-group=%s -size=%d",
-		volumeGroup,
-		request.CapacityRange.RequiredBytes,
-	)
-	klog.InfoS("creating volume", "command", createPvCommand)
-	stdout, stderr, err := s.CommandRunner.RunCommand(createPvCommand)
+	backend := storageBackends[parameters.Backend]
+	if parameters.ThinPool != "" {
+		poolCapacity, err := backend.capacity(helper, parameters)
+		if err != nil {
+			return nil, err
+		}
+		logPoolCapacity(parameters, poolCapacity)
+		if err := checkThinPoolSpace(poolCapacity, parameters, capacity); err != nil {
+			return nil, err
+		}
+	}
 
-	hopefullyVolumeId := strings.TrimSpace(stdout)
+	klog.InfoS("creating volume", "backend", parameters.Backend, "size", capacity)
+	created, err := backend.create(helper, parameters, capacity)
+	if err != nil {
+		klog.InfoS("error creating volume", "backend", parameters.Backend, "err", err.Error())
+		return response, errors.New("unknown error creating volume")
+	}
 
-	if !strings.HasPrefix(hopefullyVolumeId, "pv-") || err != nil {
-		errMsg := ""
-		if err != nil {
-			errMsg = err.Error()
+	response.Volume.VolumeId = formatVolumeId(parameters.Backend, created.Id)
+	response.Volume.CapacityBytes = capacity
+	if created.Capacity > 0 {
+		if created.Capacity < capacity {
+			klog.ErrorS(nil, "volume is smaller than requested", "pv-id", created.Id, "capacity", created.Capacity, "requested", capacity)
+		}
+		if limit := request.CapacityRange.GetLimitBytes(); limit > 0 && created.Capacity > limit {
+			// Left behind it would never be deleted, the CO retries with a new volume
+			klog.ErrorS(nil, "volume is larger than the limit, deleting it", "pv-id", created.Id, "capacity", created.Capacity, "limit", limit)
+			if err := backend.delete(helper, created.Id); err != nil {
+				klog.ErrorS(err, "couldn't delete volume larger than the limit", "pv-id", created.Id)
+			}
+			return nil, status.Error(codes.OutOfRange, fmt.Sprintf("volume was created with %d bytes, more than limit bytes %d", created.Capacity, limit))
 		}
-		klog.InfoS("error running libvirt-storage-attach", "operation", "create", "stdout", stdout, "stderr", stderr, "err", errMsg, "parsedVolumeId", hopefullyVolumeId)
-		err = errors.New("unknown error creating volume")
-	} else {
-		response.Volume.VolumeId = hopefullyVolumeId
+		response.Volume.CapacityBytes = created.Capacity
 	}
 
 	return response, err
@@ -186,19 +353,19 @@ func (s *LibvirtCsiController) DeleteVolume(ctx context.Context, request *csi.De
 	logRequest("deleting volume", request)
 	response := &csi.DeleteVolumeResponse{}
 
-	stdout, stderr, err := s.CommandRunner.RunCommand(fmt.Sprintf(
-		"sudo libvirt-storage-attach -operation=delete -pv-id=%s",
-		shellescape.Quote(request.VolumeId),
-	))
-
+	helper, err := s.helperFor(request.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	backend, pvId, err := volumeBackend(request.VolumeId)
 	if err != nil {
-		klog.InfoS("error running libvirt-storage-attach", "operation", "delete", "stdout", stdout, "stderr", stderr, "err", err.Error(), "pv-id", request.VolumeId)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	err = backend.delete(helper, pvId)
 
-	// I0325 21:29:29.098228  774510 commands.go:213] "command output" stdout="" stderr="  Failed to find logical volume \"fedora_localhost-live/pv-a61a74d2-ab75-458b-bf1b-0216923ca686\"" err="exit status 5"
-	if strings.HasPrefix(strings.TrimSpace(stderr), "Failed to find logical volume") {
+	if errors.Is(err, errVolumeNotFound) {
 		klog.Errorf("volume %s not found", request.VolumeId)
-		return response, errors.New("volume not found")
+		return response, err
 	}
 
 	// TODO are there any other special errors like "volume still attached" ?
@@ -207,36 +374,47 @@ func (s *LibvirtCsiController) DeleteVolume(ctx context.Context, request *csi.De
 }
 
 func (s *LibvirtCsiController) ValidateVolumeCapabilities(ctx context.Context, request *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	response := &csi.ValidateVolumeCapabilitiesResponse{
-		Confirmed: nil,
-		Message:   "",
+	logRequest("validate volume capabilities", request)
+
+	if request.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	if len(request.VolumeCapabilities) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities are required")
 	}
 
-	responseCapabilities := make([]*csi.VolumeCapability, 0)
-	for _, capability := range request.VolumeCapabilities {
-		// Not sure if this is the right way to switch on capability...
-		switch capability.GetAccessMode().GetMode() {
-		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:
-			responseCapabilities = append(responseCapabilities, &csi.VolumeCapability{
-				AccessMode: &csi.VolumeCapability_AccessMode{
-					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
-				},
-				AccessType: &csi.VolumeCapability_Mount{
-					// All fields are optional
-					Mount: &csi.VolumeCapability_MountVolume{},
-				},
-			})
-		default:
-		}
+	helper, err := s.helperFor(request.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	volume, err := getVolume(helper, request.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if volume == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("volume %s not found", request.VolumeId))
 	}
 
-	response.Confirmed = &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
-		VolumeCapabilities: responseCapabilities,
-		VolumeContext:      request.VolumeContext,
-		Parameters:         nil,
+	// Confirmed must be left empty unless every capability is supported
+	multiAttach := request.VolumeContext[parameterMultiAttach] == "true"
+	if err := validateCapabilities(request.VolumeCapabilities, multiAttach); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
 	}
 
-	return response, nil
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeCapabilities: request.VolumeCapabilities,
+			VolumeContext:      request.VolumeContext,
+			Parameters:         request.Parameters,
+		},
+	}, nil
+}
+
+// Capabilities whose RPCs don't get secrets and only cover the default account
+var defaultAccountCapabilities = map[csi.ControllerServiceCapability_RPC_Type]struct{}{
+	csi.ControllerServiceCapability_RPC_LIST_VOLUMES:                 {},
+	csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES: {},
+	csi.ControllerServiceCapability_RPC_GET_CAPACITY:                 {},
 }
 
 func (s *LibvirtCsiController) ControllerGetCapabilities(ctx context.Context, request *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
@@ -270,48 +448,237 @@ func (s *LibvirtCsiController) ControllerGetCapabilities(ctx context.Context, re
 					},
 				},
 			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_PUBLISH_READONLY,
+					},
+				},
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+					},
+				},
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+					},
+				},
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+					},
+				},
+			},
 		},
 	}
+	// Without secrets these only see the default account, so the sidecars would take volumes on the other
+	// accounts for detached or report the wrong pool's capacity
+	if s.NewCommandRunner != nil {
+		capabilities := response.Capabilities[:0]
+		for _, capability := range response.Capabilities {
+			if _, ok := defaultAccountCapabilities[capability.GetRpc().GetType()]; !ok {
+				capabilities = append(capabilities, capability)
+			}
+		}
+		response.Capabilities = capabilities
+	}
 	return response, nil
 }
 
 func (s *LibvirtCsiController) ControllerPublishVolume(ctx context.Context, request *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
 	logRequest("publish volume", request)
 
-	stdout, stderr, err := s.CommandRunner.RunCommand(fmt.Sprintf(
-		"sudo libvirt-storage-attach -operation=attach -pv-id=%s -vm-name=%s",
-		shellescape.Quote(request.VolumeId),
-		shellescape.Quote(request.NodeId),
-	))
+	helper, err := s.helperFor(request.Secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the current attachments first so retries (e.g. after a timeout) succeed
+	volume, err := getVolume(helper, request.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if volume == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("volume %s not found", request.VolumeId))
+	}
+	readOnly := request.Readonly || isReadOnlyMode(request.GetVolumeCapability().GetAccessMode().GetMode())
+	if owner, ok := volume.ownerFor(request.NodeId); ok {
+		klog.InfoS("volume already attached", "pv-id", request.VolumeId, "node", request.NodeId)
+		attachInfo, known := volume.Attachments[owner]
+		if known && attachInfo.ReadOnly != readOnly {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("volume %s is attached to %s with readonly=%t", request.VolumeId, owner, attachInfo.ReadOnly))
+		}
+		return &csi.ControllerPublishVolumeResponse{
+			PublishContext: attachInfo.publishContext(),
+		}, nil
+	}
+	// Attaching a second time could hand a single node volume to two domains, so don't guess
+	if ambiguous := volume.ambiguousOwners(request.NodeId); len(ambiguous) > 0 {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %s is attached to %s and libvirt-storage-attach doesn't report domain UUIDs, "+
+			"can't tell whether that's node %s", request.VolumeId, strings.Join(ambiguous, ","), request.NodeId))
+	}
+	if len(volume.Owners) > 0 && !isMultiNodeMode(request.GetVolumeCapability().GetAccessMode().GetMode()) {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %s is already attached to %s", request.VolumeId, strings.Join(volume.Owners, ",")))
+	}
 
+	attachRequest := newVolumeRequest(helperOperationAttach, request.VolumeId)
+	attachRequest.ReadOnly = readOnly
+	attachRequest.Shareable = request.VolumeContext[parameterMultiAttach] == "true"
+	tuning, err := parseDiskTuning(mergeTuningParameters(request.VolumeContext, volume.Attributes), attachRequest.Shareable)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	tuning.apply(attachRequest)
+	attachRequest.setDomain(request.NodeId)
+	stdout, _, err := helper.run(attachRequest)
 	if err != nil {
-		klog.InfoS("error running libvirt-storage-attach", "operation", "attach", "stdout", stdout, "stderr", stderr, "err", err.Error(), "pv-id", request.VolumeId)
+		return &csi.ControllerPublishVolumeResponse{}, err
 	}
 
+	// Older versions of libvirt-storage-attach don't report the disk. The node falls back to searching for the serial
+	var attachInfo AttachInfo
+	if jsonErr := json.Unmarshal([]byte(stdout), &attachInfo); jsonErr != nil {
+		klog.InfoS("libvirt-storage-attach didn't report disk details", "stdout", stdout, "err", jsonErr.Error(), "pv-id", request.VolumeId)
+	}
+
+	// Only the attach that found the volume unused hands out fresh. The node also remembers volumes it set up,
+	// since the PublishContext stays the same for as long as the volume is attached
+	publishContext := attachInfo.publishContext()
+	if volume.isFresh() {
+		publishContext[publishContextFresh] = "true"
+	}
 	return &csi.ControllerPublishVolumeResponse{
-		PublishContext: map[string]string{},
-	}, err
+		PublishContext: publishContext,
+	}, nil
 }
 
 func (s *LibvirtCsiController) ControllerUnpublishVolume(ctx context.Context, request *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
 	logRequest("unpublish volume", request)
+	response := &csi.ControllerUnpublishVolumeResponse{}
 
-	stdout, stderr, err := s.CommandRunner.RunCommand(fmt.Sprintf(
-		"sudo libvirt-storage-attach -operation=detach -pv-id=%s -vm-name=%s",
-		shellescape.Quote(request.VolumeId),
-		shellescape.Quote(request.NodeId),
-	))
+	helper, err := s.helperFor(request.Secrets)
+	if err != nil {
+		return nil, err
+	}
 
+	// A volume that's gone or no longer attached counts as unpublished
+	volume, err := getVolume(helper, request.VolumeId)
 	if err != nil {
-		klog.InfoS("error running libvirt-storage-attach", "operation", "detach", "stdout", stdout, "stderr", stderr, "err", err.Error(), "pv-id", request.VolumeId)
+		return nil, err
+	}
+	if volume == nil {
+		klog.InfoS("volume not found, nothing to detach", "pv-id", request.VolumeId)
+		return response, nil
+	}
+
+	// An empty node ID means detach from every node
+	var domains []string
+	if request.NodeId == "" {
+		for _, owner := range volume.Owners {
+			domains = append(domains, volume.ownerDomain(owner))
+		}
+	} else if owner, ok := volume.ownerFor(request.NodeId); ok {
+		domains = []string{volume.ownerDomain(owner)}
+	} else if ambiguous := volume.ambiguousOwners(request.NodeId); len(ambiguous) > 0 {
+		// The node may be one of them, the helper knows whether the volume is attached to the domain with this UUID
+		klog.InfoS("owner UUIDs unknown, detaching by node UUID", "pv-id", request.VolumeId, "node", request.NodeId, "owners", ambiguous)
+		domains = []string{request.NodeId}
+	}
+	if len(domains) == 0 {
+		klog.InfoS("volume already detached", "pv-id", request.VolumeId, "node", request.NodeId)
+		return response, nil
+	}
+
+	for _, domain := range domains {
+		detachRequest := newVolumeRequest(helperOperationDetach, request.VolumeId)
+		detachRequest.setDomain(domain)
+		if _, _, err := helper.run(detachRequest); err != nil {
+			return response, err
+		}
 	}
 
-	return &csi.ControllerUnpublishVolumeResponse{}, err
+	return response, nil
 }
 
 func (s *LibvirtCsiController) GetCapacity(ctx context.Context, request *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	// TODO v2
-	return nil, status.Error(codes.Unimplemented, "")
+	logRequest("get capacity", request)
+
+	// GetCapacity doesn't get secrets, so this is the default account's capacity. The capability isn't advertised if
+	// secrets are enabled
+	helper, err := s.helperFor(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	parameters, err := parseVolumeParameters(request.Parameters)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	capacity, err := storageBackends[parameters.Backend].capacity(helper, parameters)
+	if err != nil {
+		return nil, err
+	}
+	logPoolCapacity(parameters, capacity)
+
+	return getCapacityResponse(capacity, parameters), nil
+}
+
+func (s *LibvirtCsiController) ControllerModifyVolume(ctx context.Context, request *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	logRequest("modify volume", request)
+
+	if request.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	var immutable []string
+	for key := range request.MutableParameters {
+		if _, ok := mutableParameters[key]; !ok {
+			immutable = append(immutable, key)
+		}
+	}
+	if len(immutable) > 0 {
+		sort.Strings(immutable)
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("parameters %s can't be modified", strings.Join(immutable, ", ")))
+	}
+
+	helper, err := s.helperFor(request.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	volume, err := getVolume(helper, request.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if volume == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("volume %s not found", request.VolumeId))
+	}
+
+	// The VolumeContext isn't available here, the StorageClass settings stored on the volume are checked the way
+	// ControllerPublishVolume will see them. Volumes created before they were stored only have the defaults and
+	// whatever was modified before, a volume attached to several domains has to be a shared one
+	multiAttach := len(volume.Owners) > 1
+	if stored, ok := volume.Attributes[parameterMultiAttach]; ok {
+		multiAttach = stored == "true"
+	}
+	tuning, err := parseDiskTuning(mergeTuningParameters(volume.Attributes, request.MutableParameters), multiAttach)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	modifyRequest := newVolumeRequest(helperOperationModify, request.VolumeId)
+	tuning.apply(modifyRequest)
+	if _, _, err := helper.run(modifyRequest); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("couldn't modify volume %s: %s", request.VolumeId, err))
+	}
+
+	return &csi.ControllerModifyVolumeResponse{}, nil
 }
 
 func (s *LibvirtCsiController) ControllerExpandVolume(ctx context.Context, request *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
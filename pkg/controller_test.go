@@ -5,54 +5,69 @@ import (
 	"errors"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
-	"io"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
 	"testing"
 )
 
-type mockWinRmClient struct {
-	ReturnCode int
-	Error      error
-	Stderr     string
-	Stdout     string
+type mockSshRunner struct {
+	Commands []string
+	Stdins   [][]byte
+	Error    error
+	Stderr   string
+	Stdout   string
+	// Optional per-operation stdout, keyed by the -operation value
+	Outputs map[string]string
 }
 
-func (m mockWinRmClient) RunWithContext(ctx context.Context, command string, stdout, stderr io.Writer) (int, error) {
-	if len(m.Stdout) > 0 {
-		stdout.Write([]byte(m.Stdout))
+func (m *mockSshRunner) RunCommand(command string, stdin []byte) (string, string, error) {
+	m.Commands = append(m.Commands, command)
+	m.Stdins = append(m.Stdins, stdin)
+	for operation, stdout := range m.Outputs {
+		if strings.Contains(command, "-operation="+operation+" ") || strings.HasSuffix(command, "-operation="+operation) {
+			return stdout, m.Stderr, m.Error
+		}
 	}
-	if len(m.Stderr) > 0 {
-		stderr.Write([]byte(m.Stderr))
-	}
-	return m.ReturnCode, m.Error
+	return m.Stdout, m.Stderr, m.Error
 }
 
-func newController() (*mockWinRmClient, *LibvirtCsiController) {
-	mockWinRm := &mockWinRmClient{
-		ReturnCode: 0,
-		Error:      nil,
+func (m *mockSshRunner) ranOperation(operation string) bool {
+	for _, command := range m.Commands {
+		if strings.Contains(command, "-operation="+operation+" ") || strings.HasSuffix(command, "-operation="+operation) {
+			return true
+		}
 	}
-	return mockWinRm, &LibvirtCsiController{
+	return false
+}
+
+const testListOutput = `[{"Id":"pv-a61a74d2-ab75-458b-bf1b-0216923ca686","Capacity":1073741824,"Owners":[]}]`
+
+func newController() (*mockSshRunner, *LibvirtCsiController) {
+	mockSsh := &mockSshRunner{}
+	return mockSsh, &LibvirtCsiController{
 		IdentityServer:   nil,
 		ControllerServer: nil,
+		CommandRunner:    mockSsh,
 	}
 }
 
-func Test_ListVolumesPowershellGenericError(t *testing.T) {
-	mockWinRm, controller := newController()
-	mockWinRm.ReturnCode = 1
+func Test_ListVolumesGenericError(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Error = errors.New("exit status 1")
 
 	_, err := controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{
 		MaxEntries:    0,
 		StartingToken: "",
 	})
 
-	assert.Equal(t, "powershell error", err.Error())
+	assert.NotNil(t, err)
 }
 
-func Test_ListVolumesPowershellErrorMessage(t *testing.T) {
-	mockWinRm, controller := newController()
+func Test_ListVolumesErrorMessage(t *testing.T) {
+	mockSsh, controller := newController()
 	errorMsg := "a thing failed"
-	mockWinRm.Error = errors.New(errorMsg)
+	mockSsh.Error = errors.New(errorMsg)
 
 	_, err := controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{
 		MaxEntries:    0,
@@ -63,11 +78,13 @@ func Test_ListVolumesPowershellErrorMessage(t *testing.T) {
 }
 
 func Test_ListVolumesValidOutput(t *testing.T) {
-	mockWinRm, controller := newController()
-	volumeIds := []string{"eab72431-5d15-4152-a8d1-5cf4ea41627e", "eae2dc8f-a05f-4798-a2e7-2f4fc94353cf"}
+	mockSsh, controller := newController()
+	volumeIds := []string{"pv-eab72431-5d15-4152-a8d1-5cf4ea41627e", "pv-eae2dc8f-a05f-4798-a2e7-2f4fc94353cf"}
+	volumes := make([]string, 0, len(volumeIds))
 	for _, vol := range volumeIds {
-		mockWinRm.Stdout = mockWinRm.Stdout + "pv-" + vol + ".vhdx\r"
+		volumes = append(volumes, `{"Id":"`+vol+`","Capacity":1073741824,"Owners":["node-1"]}`)
 	}
+	mockSsh.Stdout = "[" + strings.Join(volumes, ",") + "]"
 
 	response, err := controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{
 		MaxEntries:    0,
@@ -79,3 +96,311 @@ func Test_ListVolumesValidOutput(t *testing.T) {
 		assert.Equal(t, vol, response.Entries[i].Volume.VolumeId)
 	}
 }
+
+func Test_ControllerPublishVolumePublishContext(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{
+		"list":   testListOutput,
+		"attach": `{"Target":"sdb","Bus":"scsi","Wwn":"","Serial":"a61a74d2ab75458bbf1b0216923ca686"}`,
+	}
+
+	response, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId: "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:   "node-1",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		publishContextTarget: "sdb",
+		publishContextBus:    "scsi",
+		publishContextSerial: "a61a74d2ab75458bbf1b0216923ca686",
+	}, response.PublishContext)
+}
+
+func Test_ControllerPublishVolumeFresh(t *testing.T) {
+	for _, test := range []struct {
+		used  string
+		fresh bool
+	}{
+		{`,"Used":false`, true},
+		{`,"Used":true`, false},
+		{"", false},
+	} {
+		mockSsh, controller := newController()
+		mockSsh.Outputs = map[string]string{
+			"list":   `[{"Id":"pv-a61a74d2-ab75-458b-bf1b-0216923ca686","Owners":[]` + test.used + `}]`,
+			"attach": `{"Target":"sdb","Bus":"scsi"}`,
+		}
+
+		response, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+			VolumeId: "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+			NodeId:   "node-1",
+		})
+
+		assert.Nil(t, err)
+		_, fresh := response.PublishContext[publishContextFresh]
+		assert.Equal(t, test.fresh, fresh, test.used)
+	}
+}
+
+func Test_ControllerPublishVolumeLegacyOutput(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": testListOutput, "attach": "attached\n"}
+
+	response, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId: "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:   "node-1",
+	})
+
+	assert.Nil(t, err)
+	assert.Empty(t, response.PublishContext)
+}
+
+func Test_ControllerPublishVolumeAlreadyAttached(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": `[{"Id":"pv-a61a74d2-ab75-458b-bf1b-0216923ca686","Owners":["node-1"],
+		"Attachments":{"node-1":{"Target":"vdb","Bus":"virtio","Serial":"a61a74d2ab75458bbf1b"}}}]`}
+
+	response, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId: "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:   "node-1",
+	})
+
+	assert.Nil(t, err)
+	assert.False(t, mockSsh.ranOperation("attach"))
+	assert.Equal(t, "vdb", response.PublishContext[publishContextTarget])
+}
+
+func Test_ControllerPublishVolumeAttachedElsewhere(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": `[{"Id":"pv-a61a74d2-ab75-458b-bf1b-0216923ca686","Owners":["node-2"]}]`}
+
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId: "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:   "node-1",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.False(t, mockSsh.ranOperation("attach"))
+}
+
+func Test_ControllerPublishVolumeNotFound(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": `[]`}
+
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId: "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:   "node-1",
+	})
+
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func Test_ControllerUnpublishVolumeAlreadyDetached(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": `[{"Id":"pv-a61a74d2-ab75-458b-bf1b-0216923ca686","Owners":["node-2"]}]`}
+
+	_, err := controller.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:   "node-1",
+	})
+
+	assert.Nil(t, err)
+	assert.False(t, mockSsh.ranOperation("detach"))
+}
+
+func Test_ControllerUnpublishVolumeAttached(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": `[{"Id":"pv-a61a74d2-ab75-458b-bf1b-0216923ca686","Owners":["node-1"]}]`}
+
+	_, err := controller.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:   "node-1",
+	})
+
+	assert.Nil(t, err)
+	assert.True(t, mockSsh.ranOperation("detach"))
+}
+
+func Test_ControllerPublishVolumeByUuid(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": testListOutput}
+
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId: "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:   "0F3C2B1A-5D6E-4F70-8192-A3B4C5D6E7F8",
+	})
+
+	assert.Nil(t, err)
+	assert.Contains(t, mockSsh.Commands[len(mockSsh.Commands)-1], " -vm-uuid=0f3c2b1a-5d6e-4f70-8192-a3b4c5d6e7f8")
+}
+
+func Test_ControllerUnpublishVolumeByUuid(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": `[{"Id":"pv-a61a74d2-ab75-458b-bf1b-0216923ca686","Owners":["node-1"],
+		"OwnerUuids":{"node-1":"0f3c2b1a-5d6e-4f70-8192-a3b4c5d6e7f8"}}]`}
+
+	_, err := controller.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:   "0f3c2b1a-5d6e-4f70-8192-a3b4c5d6e7f8",
+	})
+
+	assert.Nil(t, err)
+	assert.True(t, mockSsh.ranOperation("detach"))
+	assert.Contains(t, mockSsh.Commands[len(mockSsh.Commands)-1], " -vm-uuid=0f3c2b1a-5d6e-4f70-8192-a3b4c5d6e7f8")
+}
+
+func Test_ControllerUnpublishVolumeUnknownOwnerUuids(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": `[{"Id":"pv-a61a74d2-ab75-458b-bf1b-0216923ca686","Owners":["node-1"]}]`}
+
+	_, err := controller.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:   "0f3c2b1a-5d6e-4f70-8192-a3b4c5d6e7f8",
+	})
+
+	assert.Nil(t, err)
+	assert.True(t, mockSsh.ranOperation("detach"))
+	assert.Contains(t, mockSsh.Commands[len(mockSsh.Commands)-1], " -vm-uuid=0f3c2b1a-5d6e-4f70-8192-a3b4c5d6e7f8")
+}
+
+func Test_ControllerPublishVolumeUnknownOwnerUuids(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": `[{"Id":"pv-a61a74d2-ab75-458b-bf1b-0216923ca686","Owners":["node-1"]}]`}
+
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId: "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:   "0f3c2b1a-5d6e-4f70-8192-a3b4c5d6e7f8",
+	})
+
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "doesn't report domain UUIDs")
+	assert.False(t, mockSsh.ranOperation("attach"))
+}
+
+func Test_ControllerPublishVolumeReadOnly(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": testListOutput, "attach": `{"Target":"sdb","Bus":"scsi","ReadOnly":true}`}
+
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId: "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:   "node-1",
+		Readonly: true,
+	})
+
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(mockSsh.Commands[len(mockSsh.Commands)-1], " -readonly"))
+}
+
+func Test_ControllerPublishVolumeReadOnlyMismatch(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": `[{"Id":"pv-a61a74d2-ab75-458b-bf1b-0216923ca686","Owners":["node-1"],
+		"Attachments":{"node-1":{"Target":"sdb","Bus":"scsi","ReadOnly":false}}}]`}
+
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId: "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:   "node-1",
+		Readonly: true,
+	})
+
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+func multiNodeBlockCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+	}
+}
+
+func Test_CreateVolumeMultiAttach(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"create": "pv-a61a74d2-ab75-458b-bf1b-0216923ca686\n"}
+
+	response, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{multiNodeBlockCapability()},
+		Parameters:         map[string]string{parameterMultiAttach: "true"},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "true", response.Volume.VolumeContext[parameterMultiAttach])
+}
+
+func Test_CreateVolumeMultiAttachFilesystem(t *testing.T) {
+	_, controller := newController()
+	capability := multiNodeBlockCapability()
+	capability.AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}
+
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{capability},
+		Parameters:         map[string]string{parameterMultiAttach: "true"},
+	})
+
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func Test_ControllerPublishVolumeShareable(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": `[{"Id":"pv-a61a74d2-ab75-458b-bf1b-0216923ca686","Owners":["node-2"]}]`}
+
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:           "node-1",
+		VolumeCapability: multiNodeBlockCapability(),
+		VolumeContext:    map[string]string{parameterMultiAttach: "true"},
+	})
+
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(mockSsh.Commands[len(mockSsh.Commands)-1], " -shareable"))
+}
+
+func Test_ValidateVolumeCapabilitiesUnsupported(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": testListOutput}
+
+	response, err := controller.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId: "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER),
+			mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER),
+		},
+	})
+
+	assert.Nil(t, err)
+	assert.Nil(t, response.Confirmed)
+	assert.Contains(t, response.Message, "MULTI_NODE_SINGLE_WRITER")
+}
+
+func Test_ValidateVolumeCapabilitiesConfirmed(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": testListOutput}
+	capabilities := []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER)}
+
+	response, err := controller.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		VolumeCapabilities: capabilities,
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, capabilities, response.Confirmed.VolumeCapabilities)
+}
+
+func Test_CreateVolumeEncryptedMultiAttach(t *testing.T) {
+	_, controller := newController()
+
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{multiNodeBlockCapability()},
+		Parameters:         map[string]string{parameterMultiAttach: "true", parameterEncrypted: "true"},
+	})
+
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+	"time"
+)
+
+// Runners for credentials no request used for this long are dropped, e.g. after the secret was rotated
+const runnerIdleTimeout = time.Hour
+
+// cachedRunner Runner for a set of credentials and when a request last used it
+type cachedRunner struct {
+	runner   RemoteSshRunner
+	lastUsed time.Time
+}
+
+// Keys of the provisioner and controller publish secrets (csi.storage.k8s.io/provisioner-secret-name etc.)
+// selecting the hypervisor account a StorageClass uses
+const secretSshHost = "host"
+const secretSshUser = "user"
+const secretSshPrivateKey = "privateKey"
+const secretSshKnownHosts = "knownHosts"
+
+// Optional keys of the same secrets
+const secretSshPrivateKeyPassphrase = "privateKeyPassphrase"
+const secretSshCertificate = "certificate" // OpenSSH user certificate for privateKey
+
+// SshCredentials Hypervisor account from a CSI secret
+type SshCredentials struct {
+	Host       string // host:port
+	User       string
+	PrivateKey string // PEM
+	KnownHosts string // known_hosts file content
+
+	PrivateKeyPassphrase string
+	Certificate          string
+}
+
+// parseSshCredentials Read the SSH credentials out of a CSI secret, which has to hold at least the required keys
+func parseSshCredentials(secrets map[string]string) (SshCredentials, error) {
+	credentials := SshCredentials{
+		Host:       secrets[secretSshHost],
+		User:       secrets[secretSshUser],
+		PrivateKey: secrets[secretSshPrivateKey],
+		KnownHosts: secrets[secretSshKnownHosts],
+
+		PrivateKeyPassphrase: secrets[secretSshPrivateKeyPassphrase],
+		Certificate:          secrets[secretSshCertificate],
+	}
+	for key, value := range map[string]string{
+		secretSshHost:       credentials.Host,
+		secretSshUser:       credentials.User,
+		secretSshPrivateKey: credentials.PrivateKey,
+		secretSshKnownHosts: credentials.KnownHosts,
+	} {
+		if value == "" {
+			return credentials, fmt.Errorf("SSH secret is missing %s", key)
+		}
+	}
+	return credentials, nil
+}
+
+// credentialsKey Digest identifying a set of secrets without keeping them around as map keys
+func credentialsKey(secrets map[string]string) string {
+	keys := make([]string, 0, len(secrets))
+	for key := range secrets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	digest := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(digest, "%d:%s%d:%s", len(key), key, len(secrets[key]), secrets[key])
+	}
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+// helperFor The helper for the hypervisor account in a request's secrets, or the default one if the StorageClass
+// doesn't configure secrets. Runners are cached per set of credentials until they're idle for runnerIdleTimeout
+func (s *LibvirtCsiController) helperFor(secrets map[string]string) (*helperClient, error) {
+	if len(secrets) == 0 {
+		if s.CommandRunner == nil {
+			return nil, status.Error(codes.FailedPrecondition, "no SSH secret given and no default SSH credentials configured")
+		}
+		return &helperClient{runner: s.CommandRunner, mode: s.HelperMode}, nil
+	}
+
+	credentials, err := parseSshCredentials(secrets)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if s.NewCommandRunner == nil {
+		return nil, status.Error(codes.FailedPrecondition, "SSH secrets aren't supported by this controller")
+	}
+
+	key := credentialsKey(secrets)
+	now := time.Now()
+	s.runnerLock.Lock()
+	defer s.runnerLock.Unlock()
+	if s.runners == nil {
+		s.runners = make(map[string]*cachedRunner)
+	}
+	for cachedKey, cached := range s.runners {
+		if now.Sub(cached.lastUsed) > runnerIdleTimeout {
+			delete(s.runners, cachedKey)
+		}
+	}
+	cached, ok := s.runners[key]
+	if !ok {
+		cached = &cachedRunner{runner: s.NewCommandRunner(credentials)}
+		s.runners[key] = cached
+	}
+	cached.lastUsed = now
+	return &helperClient{runner: cached.runner, mode: s.HelperMode}, nil
+}
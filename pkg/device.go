@@ -0,0 +1,255 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// virtio-blk truncates serials to 20 characters. Anything shorter than this can't be a (truncated) volume serial
+// and is more likely an unrelated disk with a short serial like "1"
+const minVolumeSerialLength = 20
+
+const deviceDiscoveryTimeout = 30 * time.Second
+const deviceDiscoveryInterval = 500 * time.Millisecond
+
+// udev's by-id links, the kernel's block devices and udev's device properties
+var diskByIdDir = "/dev/disk/by-id"
+var sysBlockDir = "/sys/class/block"
+var udevDataDir = "/run/udev/data"
+
+// Prefixes udev uses for /dev/disk/by-id links of disks libvirt attaches, followed by the disk serial
+var diskByIdBusPrefixes = map[string]string{
+	"virtio": "virtio-",                   // virtio-blk
+	"scsi":   "scsi-0QEMU_QEMU_HARDDISK_", // virtio-scsi
+	"nvme":   "nvme-QEMU_NVMe_Ctrl_",      // nvme
+}
+
+// diskByIdPrefixes by-id prefixes to search for a disk attached to bus, or all of them if the bus isn't known
+func diskByIdPrefixes(bus string) []string {
+	if prefix, ok := diskByIdBusPrefixes[bus]; ok {
+		return []string{prefix}
+	}
+	prefixes := make([]string, 0, len(diskByIdBusPrefixes))
+	for _, prefix := range diskByIdBusPrefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// volumeSerial Serial libvirt assigns to the disk backing a volume, whatever its backend
+func volumeSerial(volumeId string) string {
+	_, pvId := splitVolumeId(volumeId)
+	return strings.Replace(strings.TrimPrefix(pvId, "pv-"), "-", "", -1)
+}
+
+// serialMatchesVolume Check whether a (possibly truncated) disk serial belongs to a volume
+func serialMatchesVolume(serial string, volumeSerial string) bool {
+	if serial == volumeSerial {
+		return true
+	}
+	return len(serial) >= minVolumeSerialLength && strings.HasPrefix(volumeSerial, serial)
+}
+
+// serialFromDiskById Extract the disk serial from a /dev/disk/by-id link name
+func serialFromDiskById(name string, prefixes []string) (string, bool) {
+	if strings.Contains(name, "-part") {
+		return "", false
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return strings.TrimPrefix(name, prefix), true
+		}
+	}
+	return "", false
+}
+
+// readUdevProperties Read the E: properties udev recorded for a block device given as "major:minor"
+func readUdevProperties(majorMinor string) (map[string]string, error) {
+	file, err := os.Open(filepath.Join(udevDataDir, "b"+majorMinor))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	properties := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, found := strings.CutPrefix(scanner.Text(), "E:")
+		if !found {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok {
+			properties[key] = value
+		}
+	}
+	return properties, scanner.Err()
+}
+
+// devicesFromDiskById Devices with a /dev/disk/by-id link for one of the given prefixes whose serial matches
+func devicesFromDiskById(serial string, prefixes []string) ([]string, error) {
+	entries, err := os.ReadDir(diskByIdDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var devices []string
+	for _, entry := range entries {
+		diskSerial, ok := serialFromDiskById(entry.Name(), prefixes)
+		if !ok || !serialMatchesVolume(diskSerial, serial) {
+			continue
+		}
+		device, err := filepath.EvalSymlinks(filepath.Join(diskByIdDir, entry.Name()))
+		if err != nil {
+			klog.InfoS("skipping dangling disk link", "link", entry.Name(), "err", err)
+			continue
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// udevSerial Serial udev recorded for a whole disk, given its kernel name
+func udevSerial(name string) (string, bool) {
+	majorMinor, err := os.ReadFile(filepath.Join(sysBlockDir, name, "dev"))
+	if err != nil {
+		return "", false
+	}
+	properties, err := readUdevProperties(strings.TrimSpace(string(majorMinor)))
+	if err != nil || properties["DEVTYPE"] != "disk" {
+		return "", false
+	}
+	if serial := properties["ID_SERIAL_SHORT"]; serial != "" {
+		return serial, true
+	}
+	serial := properties["ID_SERIAL"]
+	return serial, serial != ""
+}
+
+// devicesFromUdev Whole disks whose udev serial matches the volume. This covers disks udev didn't create a
+// recognizable by-id link for
+func devicesFromUdev(serial string) ([]string, error) {
+	entries, err := os.ReadDir(sysBlockDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var devices []string
+	for _, entry := range entries {
+		if diskSerial, ok := udevSerial(entry.Name()); ok && serialMatchesVolume(diskSerial, serial) {
+			devices = append(devices, "/dev/"+entry.Name())
+		}
+	}
+	return devices, nil
+}
+
+// uniqueDevices Sorted distinct device paths
+func uniqueDevices(devices []string) []string {
+	unique := make(map[string]struct{})
+	for _, device := range devices {
+		unique[device] = struct{}{}
+	}
+	result := make([]string, 0, len(unique))
+	for device := range unique {
+		result = append(result, device)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// scanVolumeDevices Distinct device paths that look like they back the volume
+func scanVolumeDevices(volumeId string) ([]string, error) {
+	serial := volumeSerial(volumeId)
+
+	byId, err := devicesFromDiskById(serial, diskByIdPrefixes(""))
+	if err != nil {
+		return nil, err
+	}
+	byUdev, err := devicesFromUdev(serial)
+	if err != nil {
+		return nil, err
+	}
+
+	return uniqueDevices(append(byId, byUdev...)), nil
+}
+
+// scanPublishedDevice Device paths matching the disk identity ControllerPublishVolume returned. The WWN is
+// checked first, then the serial on the bus the disk was attached to. The target is libvirt's name for the disk
+// and only used if the guest kernel happened to pick the same name and the serial confirms it
+func scanPublishedDevice(publishContext map[string]string) ([]string, error) {
+	if wwn := strings.TrimPrefix(strings.ToLower(publishContext[publishContextWwn]), "0x"); wwn != "" {
+		device, err := filepath.EvalSymlinks(filepath.Join(diskByIdDir, "wwn-0x"+wwn))
+		if err == nil {
+			return []string{device}, nil
+		}
+	}
+
+	serial := publishContext[publishContextSerial]
+	if serial == "" {
+		return nil, nil
+	}
+
+	devices, err := devicesFromDiskById(serial, diskByIdPrefixes(publishContext[publishContextBus]))
+	if err != nil || len(devices) > 0 {
+		return uniqueDevices(devices), err
+	}
+
+	if target := publishContext[publishContextTarget]; target != "" {
+		if diskSerial, ok := udevSerial(target); ok && serialMatchesVolume(diskSerial, serial) {
+			return []string{"/dev/" + target}, nil
+		}
+	}
+	return nil, nil
+}
+
+// findVolumeDevice Resolve the block device backing a volume, waiting for hot-plugged disks to show up. The disk
+// identity from the publish context is used when the controller provided one, otherwise all disks are searched
+// for the volume serial
+func findVolumeDevice(ctx context.Context, volumeId string, publishContext map[string]string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, deviceDiscoveryTimeout)
+	defer cancel()
+
+	scan := func() ([]string, error) { return scanVolumeDevices(volumeId) }
+	if publishContext[publishContextWwn] != "" || publishContext[publishContextSerial] != "" {
+		scan = func() ([]string, error) { return scanPublishedDevice(publishContext) }
+	}
+
+	for {
+		devices, err := scan()
+		if err != nil {
+			return "", err
+		}
+
+		switch len(devices) {
+		case 1:
+			klog.InfoS("found device for volume", "volumeId", volumeId, "device", devices[0])
+			return devices[0], nil
+		case 0:
+			klog.V(4).InfoS("waiting for device", "volumeId", volumeId, "volumeSerial", volumeSerial(volumeId), "publishContext", publishContext)
+		default:
+			klog.ErrorS(nil, "multiple devices match volume", "volumeId", volumeId, "devices", devices)
+			return "", status.Error(codes.Internal, fmt.Sprintf("volume %s matches multiple devices %v", volumeId, devices))
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", status.Error(codes.NotFound, fmt.Sprintf("no device found for volume %s", volumeId))
+		case <-time.After(deviceDiscoveryInterval):
+		}
+	}
+}
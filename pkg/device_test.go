@@ -0,0 +1,135 @@
+package pkg
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testVolumeId = "pv-a61a74d2-ab75-458b-bf1b-0216923ca686"
+
+func fakeDeviceTree(t *testing.T) string {
+	root := t.TempDir()
+	previousByIdDir, previousSysBlockDir, previousUdevDataDir := diskByIdDir, sysBlockDir, udevDataDir
+	t.Cleanup(func() {
+		diskByIdDir, sysBlockDir, udevDataDir = previousByIdDir, previousSysBlockDir, previousUdevDataDir
+	})
+	diskByIdDir = filepath.Join(root, "by-id")
+	sysBlockDir = filepath.Join(root, "sys")
+	udevDataDir = filepath.Join(root, "udev")
+	for _, dir := range []string{diskByIdDir, sysBlockDir, udevDataDir} {
+		assert.Nil(t, os.MkdirAll(dir, 0755))
+	}
+	return root
+}
+
+func fakeDisk(t *testing.T, root string, name string, link string) {
+	device := filepath.Join(root, name)
+	assert.Nil(t, os.WriteFile(device, nil, 0600))
+	assert.Nil(t, os.Symlink(device, filepath.Join(diskByIdDir, link)))
+}
+
+func Test_SerialMatchesVolume(t *testing.T) {
+	serial := volumeSerial(testVolumeId)
+
+	assert.Equal(t, "a61a74d2ab75458bbf1b0216923ca686", serial)
+	assert.True(t, serialMatchesVolume(serial, serial))
+	assert.True(t, serialMatchesVolume(serial[:20], serial))
+	assert.False(t, serialMatchesVolume(serial[:8], serial))
+	assert.False(t, serialMatchesVolume("", serial))
+}
+
+func Test_SerialFromDiskById(t *testing.T) {
+	serial, ok := serialFromDiskById("virtio-a61a74d2ab75458bbf1b", diskByIdPrefixes(""))
+	assert.True(t, ok)
+	assert.Equal(t, "a61a74d2ab75458bbf1b", serial)
+
+	serial, ok = serialFromDiskById("scsi-0QEMU_QEMU_HARDDISK_a61a74d2ab75458bbf1b0216923ca686", diskByIdPrefixes("scsi"))
+	assert.True(t, ok)
+	assert.Equal(t, "a61a74d2ab75458bbf1b0216923ca686", serial)
+
+	_, ok = serialFromDiskById("scsi-0QEMU_QEMU_HARDDISK_a61a74d2ab75458bbf1b0216923ca686-part1", diskByIdPrefixes(""))
+	assert.False(t, ok)
+
+	_, ok = serialFromDiskById("ata-Samsung_SSD_860_S3Z9NB0K", diskByIdPrefixes(""))
+	assert.False(t, ok)
+}
+
+func Test_FindVolumeDeviceByIdLink(t *testing.T) {
+	root := fakeDeviceTree(t)
+	fakeDisk(t, root, "vdb", "virtio-a61a74d2ab75458bbf1b")
+	fakeDisk(t, root, "sda", "scsi-0QEMU_QEMU_HARDDISK_drive-scsi0")
+
+	device, err := findVolumeDevice(context.Background(), testVolumeId, nil)
+
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(root, "vdb"), device)
+}
+
+func Test_FindVolumeDeviceUdevProperties(t *testing.T) {
+	fakeDeviceTree(t)
+	assert.Nil(t, os.MkdirAll(filepath.Join(sysBlockDir, "nvme0n1"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(sysBlockDir, "nvme0n1", "dev"), []byte("259:0\n"), 0644))
+	assert.Nil(t, os.WriteFile(
+		filepath.Join(udevDataDir, "b259:0"),
+		[]byte("S:disk/by-path/pci-0000:00:05.0-nvme-1\nE:DEVTYPE=disk\nE:ID_SERIAL_SHORT=a61a74d2ab75458bbf1b\n"),
+		0644,
+	))
+
+	device, err := findVolumeDevice(context.Background(), testVolumeId, nil)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "/dev/nvme0n1", device)
+}
+
+func Test_FindVolumeDeviceAmbiguous(t *testing.T) {
+	root := fakeDeviceTree(t)
+	fakeDisk(t, root, "vdb", "virtio-a61a74d2ab75458bbf1b")
+	fakeDisk(t, root, "sdb", "scsi-0QEMU_QEMU_HARDDISK_a61a74d2ab75458bbf1b0216923ca686")
+
+	_, err := findVolumeDevice(context.Background(), testVolumeId, nil)
+
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+func Test_FindVolumeDeviceMissing(t *testing.T) {
+	fakeDeviceTree(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := findVolumeDevice(ctx, testVolumeId, nil)
+
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func Test_FindVolumeDevicePublishContext(t *testing.T) {
+	root := fakeDeviceTree(t)
+	fakeDisk(t, root, "vdb", "virtio-a61a74d2ab75458bbf1b")
+	fakeDisk(t, root, "sdb", "scsi-0QEMU_QEMU_HARDDISK_a61a74d2ab75458bbf1b0216923ca686")
+
+	device, err := findVolumeDevice(context.Background(), testVolumeId, map[string]string{
+		publishContextTarget: "sdb",
+		publishContextBus:    "scsi",
+		publishContextSerial: "a61a74d2ab75458bbf1b0216923ca686",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(root, "sdb"), device)
+}
+
+func Test_FindVolumeDevicePublishContextWwn(t *testing.T) {
+	root := fakeDeviceTree(t)
+	fakeDisk(t, root, "sdc", "wwn-0x5000c500a1b2c3d4")
+
+	device, err := findVolumeDevice(context.Background(), testVolumeId, map[string]string{
+		publishContextWwn:    "5000c500a1b2c3d4",
+		publishContextSerial: "a61a74d2ab75458bbf1b0216923ca686",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(root, "sdc"), device)
+}
@@ -2,7 +2,6 @@ package pkg
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -11,34 +10,97 @@ import (
 	"k8s.io/klog/v2"
 	"os"
 	"os/exec"
-	"regexp"
-	"strconv"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
-// TODO figure out max disks that can be attached to a libvirt domain. Looks like this used to be 26 but maybe
-// this has been increased since then
-const scsiControllerAvailable = 20
-const defaultFilesystem = "ext4"
+type LibvirtCsiDriver struct {
+	csi.NodeServer
 
-type BlockDevice struct {
-	Name   string `json:"name"`
-	Serial string `json:"serial"`
+	// Overrides the attach limit detected from the VM's controllers if set
+	MaxVolumesPerNode int64
+	// Bus libvirt-storage-attach attaches disks to, see ParseAttachBus, and how many disks fit on a SCSI controller
+	AttachBus              string
+	DisksPerScsiController int64
+
+	// How to determine the NodeId, one of the nodeIdSource constants
+	NodeIdSource  string
+	NodeName      string
+	NodeIdMapFile string
+
+	conditionLock sync.Mutex
+	conditions    map[string]*csi.VolumeCondition
+
+	// Kernel log errors per device name, see scanKernelLog
+	kernelLogLock     sync.Mutex
+	kernelLogScanned  bool
+	kernelLogSequence uint64
+	deviceErrors      map[string]string
+
+	// Mount filesystems with discard so freed blocks are returned to thin and file backed volumes right away
+	MountDiscard bool
+	// Run fstrim on published volumes every FstrimInterval plus up to FstrimJitter, see RunPeriodicTrim
+	FstrimInterval time.Duration
+	FstrimJitter   time.Duration
+
+	// Where the published volumes registry is kept across restarts, see publishedVolumes
+	PublishedVolumesFile string
+	publishedLock        sync.Mutex
+	published            map[string]string
+
+	// Where the volumes set up on this node are kept across restarts, see isFreshVolume
+	UsedVolumesFile string
+	usedLock        sync.Mutex
+	used            map[string]struct{}
+	usedUnknown     bool
 }
 
-type BlockDeviceList struct {
-	BlockDevices []BlockDevice `json:"blockdevices"`
+// setVolumeCondition Remember a problem found with a volume so NodeGetVolumeStats can report it. A nil condition
+// clears it
+func (s *LibvirtCsiDriver) setVolumeCondition(volumeId string, condition *csi.VolumeCondition) {
+	s.conditionLock.Lock()
+	defer s.conditionLock.Unlock()
+
+	if s.conditions == nil {
+		s.conditions = make(map[string]*csi.VolumeCondition)
+	}
+	if condition == nil {
+		delete(s.conditions, volumeId)
+	} else {
+		s.conditions[volumeId] = condition
+	}
 }
 
-type LibvirtCsiDriver struct {
-	csi.NodeServer
+func (s *LibvirtCsiDriver) volumeCondition(volumeId string) *csi.VolumeCondition {
+	s.conditionLock.Lock()
+	defer s.conditionLock.Unlock()
+
+	if condition, ok := s.conditions[volumeId]; ok {
+		return condition
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: ""}
 }
 
 func (s *LibvirtCsiDriver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	logRequest("NodeGetInfo", req)
+
+	nodeId, err := s.nodeId()
+	if err != nil {
+		klog.ErrorS(err, "couldn't determine node id", "source", s.NodeIdSource)
+		return nil, err
+	}
+	klog.InfoS("node id", "source", s.NodeIdSource, "nodeId", nodeId)
+
+	maxVolumes := s.MaxVolumesPerNode
+	if maxVolumes <= 0 {
+		maxVolumes = maxVolumesPerNode(s.AttachBus, s.DisksPerScsiController)
+	}
+
 	return &csi.NodeGetInfoResponse{
-		NodeId:             os.Getenv("KUBE_NODE_NAME"),
-		MaxVolumesPerNode:  scsiControllerAvailable,
+		NodeId:             nodeId,
+		MaxVolumesPerNode:  maxVolumes,
 		AccessibleTopology: nil,
 	}, nil
 }
@@ -55,6 +117,20 @@ func (s *LibvirtCsiDriver) NodeGetCapabilities(ctx context.Context, req *csi.Nod
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
 		},
 	}, nil
 }
@@ -65,88 +141,98 @@ func (s *LibvirtCsiDriver) NodePublishVolume(ctx context.Context, req *csi.NodeP
 
 	response := &csi.NodePublishVolumeResponse{}
 
-	// Determine filesystem type
-	fsType := defaultFilesystem
-	if req.GetVolumeCapability() != nil && req.GetVolumeCapability().GetMount() != nil && req.GetVolumeCapability().GetMount().GetFsType() != "" {
-		fsType = req.GetVolumeCapability().GetMount().GetFsType()
+	if mounted, err := isMountPoint(req.TargetPath); err != nil {
+		return response, err
+	} else if mounted {
+		klog.InfoS("volume already mounted", "pv", req.VolumeId, "target", req.TargetPath)
+		return response, nil
 	}
-	klog.V(8).Infof("using fstype %s", fsType)
 
-	// Find block device from pvc ID (vhd id)
-	blockDeviceCmd := exec.CommandContext(ctx, "lsblk", "--nodeps", "-o", "serial,name", "-J", "--include", "8,254")
-	blockDeviceJson, err := blockDeviceCmd.Output()
-	if err != nil {
-		return response, err
+	// Determine filesystem type and options
+	fsType := capabilityFilesystem(req.GetVolumeCapability(), req.GetVolumeContext())
+	klog.V(8).Infof("using fstype %s", fsType)
+	var fsOptions *filesystemOptions
+	if req.GetVolumeCapability().GetBlock() == nil {
+		var err error
+		if fsOptions, err = parseFilesystemOptions(fsType, req.GetVolumeContext()); err != nil {
+			return response, status.Error(codes.InvalidArgument, err.Error())
+		}
 	}
-	var blockDevices BlockDeviceList
-	err = json.Unmarshal(blockDeviceJson, &blockDevices)
+
+	// The disk is attached read-only in this case so it can't be partitioned or formatted here
+	readOnly := req.Readonly || isReadOnlyMode(req.GetVolumeCapability().GetAccessMode().GetMode())
+
+	// Find block device from pvc ID (disk serial)
+	devicePath, err := findVolumeDevice(ctx, req.VolumeId, req.GetPublishContext())
 	if err != nil {
+		klog.ErrorS(err, "couldn't find device for volume", "volumeId", req.VolumeId)
 		return response, err
 	}
 
-	var targetDevice string
-	volumeSerial := strings.Replace(strings.TrimPrefix(req.VolumeId, "pv-"), "-", "", -1)
-	for _, blockDevice := range blockDevices.BlockDevices {
-		klog.InfoS("searching for device", "volumeId", req.VolumeId, "volumeSerial", volumeSerial, "blockSerial", blockDevice.Serial)
-		// Some serial numbers are truncated
-		if strings.HasPrefix(volumeSerial, blockDevice.Serial) {
-			targetDevice = blockDevice.Name
-			break
-		}
-	}
+	// The device name may have belonged to another volume before
+	s.clearDeviceErrors(relatedBlockDevices(devicePath))
 
-	if targetDevice == "" {
-		klog.ErrorS(err, "couldn't find device for volume", "volumeSerial", volumeSerial, "blockDevices", blockDevices.BlockDevices, "cmdOutput", blockDeviceJson)
-		return response, errors.New("device not found")
+	// Encrypted volumes are opened first, everything else happens on the mapped device
+	fresh := s.isFreshVolume(req.VolumeId, req.GetPublishContext())
+	encrypted := isEncrypted(req.GetVolumeContext())
+	if encrypted {
+		if devicePath, err = s.openEncryptedVolume(ctx, req.VolumeId, devicePath, req.GetSecrets(), fresh, readOnly); err != nil {
+			return response, err
+		}
 	}
 
-	// Partition block device, if needed
-	devicePath := fmt.Sprintf("/dev/%s", targetDevice)
-	partitionPath := fmt.Sprintf("%s%d", devicePath, 1)
-	if _, err = os.Stat(partitionPath); err != nil {
-		klog.InfoS("partitioning pv", "pv", req.VolumeId)
-		shellCommand := []string{devicePath, "--script", "-a", "optimal", "mklabel", "gpt", "mkpart", "primary", fsType, "0%", "100%"}
-		if out, partErr := exec.CommandContext(ctx, "parted", shellCommand...).Output(); partErr != nil {
-			klog.ErrorS(partErr, "failed to partition disk", "command", shellCommand, "output", string(out))
-			return response, partErr
+	if req.GetVolumeCapability().GetBlock() != nil {
+		if fresh {
+			if err := s.markVolumeUsed(req.VolumeId); err != nil {
+				return response, err
+			}
 		}
+		return response, publishBlockVolume(ctx, devicePath, req.TargetPath, readOnly)
 	}
 
-	// Format block device, if needed
-	out, err := exec.CommandContext(ctx, "blkid", "-o", "value", "-s", "TYPE", partitionPath).Output()
+	partitioned := isPartitioned(req.GetVolumeContext()) && !encrypted
+	mountDevice, mountFsType, err := s.prepareFilesystem(ctx, req.VolumeId, devicePath, fsType, fsOptions, fresh, partitioned, readOnly)
 	if err != nil {
-		klog.ErrorS(err, "couldn't determine partition fstype", "partition", partitionPath, "output", out)
 		return response, err
 	}
-	if len(out) == 0 {
-		klog.InfoS("formatting pv", "pv", req.VolumeId, "fsType", fsType)
-		out, err := exec.CommandContext(ctx, "mkfs", "-t", fsType, partitionPath).Output()
-		if err != nil {
-			klog.ErrorS(err, "couldn't format partition", "fsType", fsType, "partition", partitionPath, "output", out)
+	if fresh {
+		if err := s.markVolumeUsed(req.VolumeId); err != nil {
 			return response, err
 		}
 	}
 
+	if err = s.checkFilesystem(ctx, req.VolumeId, mountDevice, mountFsType, fsOptions.Fsck, readOnly); err != nil {
+		return response, err
+	}
+
 	klog.InfoS("creating mount point directory", "directory", req.TargetPath)
 	err = os.MkdirAll(req.TargetPath, 0700)
 
-	// Construct mount command
+	// Construct mount command. StorageClass defaults come first so the capability's mount flags take precedence
 	mountCommand := make([]string, 0)
 	var mountFlags []string
+	if s.MountDiscard && !readOnly {
+		// First so nodiscard in the StorageClass or capability overrides it
+		mountFlags = append(mountFlags, "discard")
+	}
+	mountFlags = append(mountFlags, fsOptions.MountOptions...)
 	if req.GetVolumeCapability() != nil && req.GetVolumeCapability().GetMount() != nil {
-		mountFlags = req.GetVolumeCapability().GetMount().GetMountFlags()
+		mountFlags = append(mountFlags, req.GetVolumeCapability().GetMount().GetMountFlags()...)
+	}
+	if readOnly {
+		mountFlags = append(mountFlags, "ro")
 	}
 	if len(mountFlags) > 0 {
 		// TODO, I think this works right... (need to verify what's actually in mount flags array)
 		mountCommand = append(mountCommand, "-o")
 		mountCommand = append(mountCommand, strings.Join(mountFlags, ","))
 	}
-	mountCommand = append(mountCommand, partitionPath)
+	mountCommand = append(mountCommand, mountDevice)
 	mountCommand = append(mountCommand, req.TargetPath)
 
 	// Mount partition
 	klog.InfoS("running command", "command", mountCommand)
-	out, err = exec.CommandContext(ctx, "mount", mountCommand...).Output()
+	out, err := execCommand(ctx, "mount", mountCommand...).Output()
 	if err != nil {
 		var exitErr *exec.ExitError
 		stderrMsg := "null"
@@ -164,32 +250,71 @@ func (s *LibvirtCsiDriver) NodePublishVolume(ctx context.Context, req *csi.NodeP
 		}
 
 		klog.ErrorS(err, "volume mount error", "output", out)
+	} else if !readOnly {
+		s.addPublishedVolume(req.VolumeId, req.TargetPath)
 	}
 
 	return response, err
 }
 
+// publishBlockVolume Bind mount the raw device to the target path for volumeMode: Block
+func publishBlockVolume(ctx context.Context, devicePath string, targetPath string, readOnly bool) error {
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0750); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(targetPath, os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	mountCommand := []string{"--bind"}
+	if readOnly {
+		mountCommand = append(mountCommand, "-o", "ro")
+	}
+	mountCommand = append(mountCommand, devicePath, targetPath)
+
+	klog.InfoS("running command", "command", mountCommand)
+	if out, err := execCommand(ctx, "mount", mountCommand...).CombinedOutput(); err != nil {
+		klog.ErrorS(err, "failed to bind mount block volume", "output", string(out))
+		return err
+	}
+	return nil
+}
+
 // NodeUnpublishVolume Unmount a volume from the target path
 func (s *LibvirtCsiDriver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	logRequest("NodeUnpublishVolume", req)
 
 	response := &csi.NodeUnpublishVolumeResponse{}
-	var err error
-	out, err := exec.CommandContext(ctx, "umount", req.TargetPath).Output()
-	exec.CommandContext(ctx, "/usr/bin/rmdir", req.TargetPath)
+	if req.VolumeId == "" || req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id and target path are required")
+	}
+
+	if err := unmountAll(ctx, req.TargetPath); err != nil {
+		klog.ErrorS(err, "volume unmount error", "pv", req.VolumeId, "target", req.TargetPath)
+		return response, err
+	}
+	s.removePublishedVolume(req.TargetPath)
+
+	// A directory for filesystem volumes, a file for block volumes
+	if err := os.Remove(req.TargetPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		klog.ErrorS(err, "couldn't remove target path", "pv", req.VolumeId, "target", req.TargetPath)
+		return response, err
+	}
+
+	// The mapping stays open while the volume is still published at another target
+	inUse, err := isEncryptedVolumeInUse(req.VolumeId)
 	if err != nil {
-		if err.Error() == "exit status 32" {
-			klog.Warningf("failed to unmount %s '%s'", req.VolumeId, string(out))
-			// TODO this seemed to get stuck unless I return a normal request
-			// despite the docs suggesting this error should be returned
-			//return response, status.Error(codes.NotFound, "volume not found")
-			return response, nil
-		} else {
-			klog.ErrorS(err, "volume unmount error", "output", out)
+		return response, err
+	}
+	if !inUse {
+		if err := closeEncryptedVolume(ctx, req.VolumeId); err != nil {
+			return response, err
 		}
 	}
 
-	return response, err
+	return response, nil
 }
 
 // NodeStageVolume Not supported capability
@@ -204,48 +329,51 @@ func (s *LibvirtCsiDriver) NodeUnstageVolume(ctx context.Context, req *csi.NodeU
 	return nil, status.Error(codes.Unimplemented, "method NodeUnstageVolume not implemented")
 }
 
-// NodeGetVolumeStats Not supported capability
+// NodeGetVolumeStats Usage and condition of a published volume
 func (s *LibvirtCsiDriver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
 	// These requests are pretty frequent
 	//logRequest("NodeGetVolumeStats", req)
 
-	out, err := exec.CommandContext(ctx, "df", "-B", "1", "--output=iavail,itotal,iused,avail,size,used", req.GetStagingTargetPath()).Output()
-	if err != nil {
-		var exitErr *exec.ExitError
-		if errors.As(err, &exitErr) && strings.HasSuffix(string(exitErr.Stderr), "No such file or directory\n") {
-			return &csi.NodeGetVolumeStatsResponse{}, status.Error(codes.NotFound, "volume not found")
-		}
-		klog.Error(err)
+	if req.VolumeId == "" || req.VolumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id and volume path are required")
 	}
 
-	statsLine := strings.Split(string(out), "\n")[1]
-	re := regexp.MustCompile("\\s+")
-	stats := re.Split(statsLine, -1)
-	klog.InfoS("stats line", "volume", req.GetStagingTargetPath(), "line", stats)
-
-	inodesAvail, _ := strconv.ParseInt(stats[0], 10, 64)
-	inodesTotal, _ := strconv.ParseInt(stats[1], 10, 64)
-	inodesUsed, _ := strconv.ParseInt(stats[2], 10, 64)
-
-	bytesAvail, _ := strconv.ParseInt(stats[3], 10, 64)
-	bytesTotal, _ := strconv.ParseInt(stats[4], 10, 64)
-	bytesUsed, _ := strconv.ParseInt(stats[5], 10, 64)
+	info, err := os.Stat(req.VolumePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("volume path %s doesn't exist", req.VolumePath))
+	}
+	if err != nil {
+		return nil, err
+	}
+	mount, err := findMount(req.VolumePath)
+	if err != nil {
+		return nil, err
+	}
+	if mount == nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("volume %s isn't mounted at %s", req.VolumeId, req.VolumePath))
+	}
 
 	response := &csi.NodeGetVolumeStatsResponse{
-		Usage: []*csi.VolumeUsage{{
-			Unit:      csi.VolumeUsage_INODES,
-			Available: inodesAvail,
-			Total:     inodesTotal,
-			Used:      inodesUsed,
-		}, {
-			Unit:      csi.VolumeUsage_BYTES,
-			Available: bytesAvail,
-			Total:     bytesTotal,
-			Used:      bytesUsed,
-		}},
-		VolumeCondition: &csi.VolumeCondition{Abnormal: false, Message: ""},
+		VolumeCondition: s.volumeCondition(req.VolumeId),
+	}
+	if condition := s.checkMountHealth(req.VolumeId, mount); condition != nil {
+		klog.ErrorS(nil, condition.Message, "pv", req.VolumeId, "path", req.VolumePath)
+		response.VolumeCondition = condition
 	}
 
+	if !info.IsDir() {
+		size, err := blockDeviceSize(req.VolumePath)
+		if err != nil {
+			klog.ErrorS(err, "couldn't get block device size", "pv", req.VolumeId, "path", req.VolumePath)
+			return response, nil
+		}
+		response.Usage = []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: size}}
+		return response, nil
+	}
+
+	if response.Usage, err = filesystemUsage(req.VolumePath); err != nil {
+		klog.ErrorS(err, "couldn't get filesystem usage", "pv", req.VolumeId, "path", req.VolumePath)
+	}
 	return response, nil
 }
 
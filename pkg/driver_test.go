@@ -0,0 +1,206 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakePublishNode A node with the test volume attached as sdb and nothing mounted. Returns the device and a target
+// path for NodePublishVolume
+func fakePublishNode(t *testing.T) (string, string) {
+	root := fakeDeviceTree(t)
+	fakeDisk(t, root, "sdb", "scsi-0QEMU_QEMU_HARDDISK_"+volumeSerial(testVolumeId))
+	fakeMountInfo(t, "")
+	return filepath.Join(root, "sdb"), filepath.Join(t.TempDir(), "mount")
+}
+
+func Test_NodePublishVolumeReadOnly(t *testing.T) {
+	device, target := fakePublishNode(t)
+	commands := fakeCommands(t, func(name string, args []string) (string, int) {
+		switch name {
+		case "wipefs":
+			return `{"signatures":[{"device":"sdb","offset":"0x438","type":"ext4"}]}`, 0
+		case "blkid":
+			return "ext4\n", 0
+		}
+		return "", 0
+	})
+	driver := &LibvirtCsiDriver{MountDiscard: true, PublishedVolumesFile: filepath.Join(t.TempDir(), "published-volumes.json")}
+
+	_, err := driver.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         testVolumeId,
+		TargetPath:       target,
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY),
+	})
+
+	assert.Nil(t, err)
+	// No discard and nothing for fstrim on a read-only mount
+	assert.Equal(t, "mount -o ro "+device+" "+target, (*commands)[len(*commands)-1])
+	assert.Empty(t, driver.publishedVolumes())
+
+	*commands = nil
+	_, err = driver.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         testVolumeId,
+		TargetPath:       target,
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "mount -o discard "+device+" "+target, (*commands)[len(*commands)-1])
+	assert.Equal(t, map[string]string{target: testVolumeId}, driver.publishedVolumes())
+}
+
+func Test_NodePublishVolumeReadOnlyBlank(t *testing.T) {
+	_, target := fakePublishNode(t)
+	commands := fakeCommands(t, func(name string, args []string) (string, int) {
+		if name == "blkid" {
+			return "", 2
+		}
+		return "", 0
+	})
+	driver := &LibvirtCsiDriver{}
+
+	_, err := driver.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         testVolumeId,
+		TargetPath:       target,
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		Readonly:         true,
+	})
+
+	assert.NotNil(t, err)
+	assert.False(t, ranCommand(commands, "mkfs"))
+	assert.False(t, ranCommand(commands, "mount"))
+	_, statErr := os.Stat(target)
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func Test_NodePublishVolumeBlock(t *testing.T) {
+	device, target := fakePublishNode(t)
+	commands := fakeCommands(t, func(name string, args []string) (string, int) { return "", 0 })
+	driver := &LibvirtCsiDriver{UsedVolumesFile: filepath.Join(t.TempDir(), "used-volumes.json")}
+
+	_, err := driver.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         testVolumeId,
+		TargetPath:       target,
+		VolumeCapability: multiNodeBlockCapability(),
+		PublishContext:   map[string]string{publishContextFresh: "true"},
+	})
+
+	assert.Nil(t, err)
+	// The raw device is handed over as is, nothing looks at or writes to it
+	assert.Equal(t, []string{"mount --bind " + device + " " + target}, *commands)
+	assert.FileExists(t, target)
+	assert.False(t, driver.isFreshVolume(testVolumeId, map[string]string{publishContextFresh: "true"}))
+
+	*commands = nil
+	_, err = driver.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         testVolumeId,
+		TargetPath:       target,
+		VolumeCapability: multiNodeBlockCapability(),
+		Readonly:         true,
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"mount --bind -o ro " + device + " " + target}, *commands)
+}
+
+func Test_NodePublishVolumeLayout(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		volumeContext map[string]string
+		partitioned   bool
+	}{
+		{"default", nil, true},
+		{"partitioned", map[string]string{parameterPartitioned: "true"}, true},
+		{"whole disk", map[string]string{parameterPartitioned: "false"}, false},
+	} {
+		device, target := fakePublishNode(t)
+		partition := device + "1"
+		commands := fakeCommands(t, func(name string, args []string) (string, int) {
+			if name == "parted" {
+				assert.Nil(t, os.WriteFile(partition, nil, 0600))
+			}
+			return "", 0
+		})
+		driver := &LibvirtCsiDriver{}
+
+		_, err := driver.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         testVolumeId,
+			TargetPath:       target,
+			VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			VolumeContext:    test.volumeContext,
+			PublishContext:   map[string]string{publishContextFresh: "true"},
+		})
+
+		assert.Nil(t, err, test.name)
+		fsDevice := device
+		if test.partitioned {
+			fsDevice = partition
+		}
+		assert.Equal(t, test.partitioned, ranCommand(commands, "parted "+device+" --script -a optimal mklabel gpt"), test.name)
+		assert.True(t, ranCommand(commands, "mkfs -t "+defaultFilesystem), test.name)
+		assert.True(t, strings.HasSuffix(mkfsCommand(*commands), " "+fsDevice), test.name)
+		assert.Equal(t, "mount "+fsDevice+" "+target, (*commands)[len(*commands)-1], test.name)
+	}
+}
+
+func Test_NodePublishVolumeExistingLayout(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		volumeContext map[string]string
+		partitioned   bool
+	}{
+		// The layout on the disk wins over the one the volume was created with
+		{"partition on whole disk volume", map[string]string{parameterPartitioned: "false"}, true},
+		{"whole disk on partitioned volume", nil, false},
+	} {
+		device, target := fakePublishNode(t)
+		fsDevice := device
+		if test.partitioned {
+			fsDevice = device + "1"
+			assert.Nil(t, os.WriteFile(fsDevice, nil, 0600))
+			assert.Nil(t, os.MkdirAll(filepath.Join(sysBlockDir, "sdb", "sdb1"), 0755))
+			assert.Nil(t, os.WriteFile(filepath.Join(sysBlockDir, "sdb", "sdb1", "partition"), []byte("1\n"), 0644))
+		}
+		commands := fakeCommands(t, func(name string, args []string) (string, int) {
+			switch {
+			case name == "wipefs" && test.partitioned && args[len(args)-1] == device:
+				return `{"signatures":[{"device":"sdb","offset":"0x200","type":"gpt"},{"device":"sdb","offset":"0x1fe","type":"PMBR"}]}`, 0
+			case name == "wipefs" && args[len(args)-1] == fsDevice:
+				return `{"signatures":[{"device":"` + filepath.Base(fsDevice) + `","offset":"0x438","type":"ext4"}]}`, 0
+			case name == "blkid":
+				return "ext4\n", 0
+			}
+			return "", 0
+		})
+		driver := &LibvirtCsiDriver{}
+
+		_, err := driver.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         testVolumeId,
+			TargetPath:       target,
+			VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			VolumeContext:    test.volumeContext,
+		})
+
+		assert.Nil(t, err, test.name)
+		assert.False(t, ranCommand(commands, "parted"), test.name)
+		assert.False(t, ranCommand(commands, "mkfs"), test.name)
+		assert.False(t, ranCommand(commands, "wipefs --all"), test.name)
+		assert.Equal(t, "mount "+fsDevice+" "+target, (*commands)[len(*commands)-1], test.name)
+	}
+}
+
+// mkfsCommand The first mkfs that ran
+func mkfsCommand(commands []string) string {
+	for _, command := range commands {
+		if strings.HasPrefix(command, "mkfs ") {
+			return command
+		}
+	}
+	return ""
+}
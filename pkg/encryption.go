@@ -0,0 +1,272 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// StorageClass parameter encrypting the volume with LUKS on the node
+const parameterEncrypted = "encrypted"
+
+// Keys of the node publish secret (csi.storage.k8s.io/node-publish-secret-name). During key rotation the secret
+// holds the new passphrase and the one the volume was last opened with
+const secretPassphrase = "passphrase"
+const secretPreviousPassphrase = "previousPassphrase"
+
+// cryptsetup isLuks exit code for a device without a LUKS header
+const cryptsetupNotLuks = 1
+
+// cryptsetup exit code for a wrong passphrase
+const cryptsetupWrongKey = 2
+
+// cryptsetup exit code when a mapping is still in use
+const cryptsetupBusy = 5
+
+// Where device mapper devices show up
+var deviceMapperDir = "/dev/mapper"
+
+func isEncrypted(volumeContext map[string]string) bool {
+	return volumeContext[parameterEncrypted] == "true"
+}
+
+// encryptedMappingName Device mapper name of an opened volume. The backend prefix is left out, helper volume ids
+// are unique anyway
+func encryptedMappingName(volumeId string) string {
+	_, pvId := splitVolumeId(volumeId)
+	return "luks-" + pvId
+}
+
+// encryptedDevice Mapped device of an opened volume
+func encryptedDevice(volumeId string) string {
+	return filepath.Join(deviceMapperDir, encryptedMappingName(volumeId))
+}
+
+// runCryptsetup Run cryptsetup passing keys through pipes so they never touch the disk. Keys are readable as
+// /dev/fd/3, /dev/fd/4 and so on
+func runCryptsetup(ctx context.Context, keys []string, args ...string) (string, error) {
+	cmd := execCommand(ctx, "cryptsetup", args...)
+	for _, key := range keys {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+		go func(key string) {
+			defer writer.Close()
+			writer.WriteString(key)
+		}(key)
+		cmd.ExtraFiles = append(cmd.ExtraFiles, reader)
+	}
+
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// testPassphrase Whether the passphrase opens one of the key slots of the LUKS device
+func testPassphrase(ctx context.Context, device string, passphrase string) (bool, error) {
+	out, err := runCryptsetup(ctx, []string{passphrase}, "open", "--type", "luks", "--test-passphrase", "--key-file=/dev/fd/3", device)
+	if exitCode(err) == cryptsetupWrongKey {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cryptsetup open --test-passphrase failed: %w: %s", err, strings.TrimSpace(out))
+	}
+	return true, nil
+}
+
+// rotateEncryptionKey Make sure the previous passphrase of the node publish secret no longer opens the volume,
+// adding the current one first if it's missing. Runs on every read-write publish while the secret has a previous
+// passphrase, so a rotation that stopped halfway is finished by the next one
+func rotateEncryptionKey(ctx context.Context, volumeId string, device string, secrets map[string]string) error {
+	passphrase := secrets[secretPassphrase]
+	previousPassphrase := secrets[secretPreviousPassphrase]
+	if passphrase == "" || previousPassphrase == "" || previousPassphrase == passphrase {
+		return nil
+	}
+
+	previousValid, err := testPassphrase(ctx, device, previousPassphrase)
+	if err != nil {
+		klog.ErrorS(err, "couldn't test previous encryption key", "pv", volumeId)
+		return status.Error(codes.Internal, fmt.Sprintf("couldn't rotate the encryption key of volume %s: %s", volumeId, err))
+	}
+	if !previousValid {
+		return nil
+	}
+
+	klog.InfoS("rotating encryption key", "pv", volumeId)
+	currentValid, err := testPassphrase(ctx, device, passphrase)
+	if err != nil {
+		klog.ErrorS(err, "couldn't test new encryption key", "pv", volumeId)
+		return status.Error(codes.Internal, fmt.Sprintf("couldn't rotate the encryption key of volume %s: %s", volumeId, err))
+	}
+	if !currentValid {
+		if out, err := runCryptsetup(ctx, []string{previousPassphrase, passphrase}, "luksAddKey", "--batch-mode", "--key-file=/dev/fd/3", device, "/dev/fd/4"); err != nil {
+			klog.ErrorS(err, "couldn't add new encryption key", "pv", volumeId, "output", out)
+			return status.Error(codes.Internal, fmt.Sprintf("couldn't add the new encryption key to volume %s: %s", volumeId, err))
+		}
+	}
+	if out, err := runCryptsetup(ctx, []string{previousPassphrase}, "luksRemoveKey", "--batch-mode", "--key-file=/dev/fd/3", device); err != nil {
+		klog.ErrorS(err, "couldn't remove previous encryption key", "pv", volumeId, "output", out)
+		return status.Error(codes.Internal, fmt.Sprintf("couldn't remove the previous encryption key from volume %s: %s", volumeId, err))
+	}
+	return nil
+}
+
+// openEncryptedVolume Open the LUKS device of a volume, formatting it first if it's blank or fresh (see
+// isFreshVolume), and return the mapped device. A previous passphrase in the secret is rotated out of the LUKS header
+// on read-write publishes, see rotateEncryptionKey
+func (s *LibvirtCsiDriver) openEncryptedVolume(ctx context.Context, volumeId string, device string, secrets map[string]string, fresh bool, readOnly bool) (string, error) {
+	name := encryptedMappingName(volumeId)
+	mappedDevice := encryptedDevice(volumeId)
+	if _, err := os.Stat(mappedDevice); err == nil {
+		backingDevice, err := encryptedBackingDevice(ctx, name)
+		if err != nil {
+			klog.ErrorS(err, "couldn't check encrypted volume mapping", "pv", volumeId, "device", mappedDevice)
+			return "", status.Error(codes.Internal, fmt.Sprintf("couldn't check the mapping of encrypted volume %s: %s", volumeId, err))
+		}
+		if sameDevice(backingDevice, device) {
+			klog.InfoS("encrypted volume already open", "pv", volumeId, "device", mappedDevice)
+			if !readOnly {
+				if err := rotateEncryptionKey(ctx, volumeId, device, secrets); err != nil {
+					return "", err
+				}
+			}
+			return mappedDevice, nil
+		}
+
+		// Left over from before the disk was detached and attached again under another name
+		klog.InfoS("closing stale encrypted volume mapping", "pv", volumeId, "mappedDevice", backingDevice, "device", device)
+		if err := closeEncryptedVolume(ctx, volumeId); err != nil {
+			return "", err
+		}
+	}
+
+	passphrase := secrets[secretPassphrase]
+	if passphrase == "" {
+		return "", status.Error(codes.InvalidArgument, fmt.Sprintf("volume %s is encrypted and the node publish secret has no %s", volumeId, secretPassphrase))
+	}
+
+	if out, err := runCryptsetup(ctx, nil, "isLuks", device); err != nil {
+		// Anything but a clean "not LUKS" may be a LUKS device that couldn't be read, formatting it would destroy it
+		if exitCode(err) != cryptsetupNotLuks {
+			klog.ErrorS(err, "couldn't check for a LUKS header", "pv", volumeId, "device", device, "output", out)
+			return "", status.Error(codes.Internal, fmt.Sprintf("couldn't check whether volume %s is encrypted: %s", volumeId, err))
+		}
+		// Only blank volumes and ones that never were attached before get formatted
+		signatures, err := listSignatures(ctx, device)
+		if err != nil {
+			return "", err
+		}
+		if len(signatures) > 0 && !fresh {
+			message := fmt.Sprintf("refusing to encrypt volume %s with existing signatures: %v", volumeId, signatures)
+			klog.ErrorS(nil, message, "pv", volumeId, "device", device)
+			s.setVolumeCondition(volumeId, &csi.VolumeCondition{Abnormal: true, Message: message})
+			return "", status.Error(codes.FailedPrecondition, message)
+		}
+		if readOnly {
+			return "", status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %s isn't encrypted yet and is published read-only", volumeId))
+		}
+
+		klog.InfoS("formatting encrypted volume", "pv", volumeId, "device", device)
+		if out, err := runCryptsetup(ctx, []string{passphrase}, "luksFormat", "--type", "luks2", "--batch-mode", "--key-file=/dev/fd/3", device); err != nil {
+			klog.ErrorS(err, "couldn't format encrypted volume", "pv", volumeId, "output", out)
+			return "", err
+		}
+	}
+
+	openArgs := []string{"open", "--type", "luks", "--key-file=/dev/fd/3"}
+	if readOnly {
+		openArgs = append(openArgs, "--readonly")
+	}
+	openArgs = append(openArgs, device, name)
+
+	out, err := runCryptsetup(ctx, []string{passphrase}, openArgs...)
+	if exitCode(err) == cryptsetupWrongKey && secrets[secretPreviousPassphrase] != "" {
+		klog.InfoS("opening encrypted volume with previous passphrase", "pv", volumeId)
+		out, err = runCryptsetup(ctx, []string{secrets[secretPreviousPassphrase]}, openArgs...)
+	}
+	if err != nil {
+		klog.ErrorS(err, "couldn't open encrypted volume", "pv", volumeId, "output", out)
+		if exitCode(err) == cryptsetupWrongKey {
+			return "", status.Error(codes.PermissionDenied, fmt.Sprintf("wrong passphrase for encrypted volume %s", volumeId))
+		}
+		return "", err
+	}
+
+	// Fails the publish, it's retried with the mapping already open
+	if !readOnly {
+		if err := rotateEncryptionKey(ctx, volumeId, device, secrets); err != nil {
+			return "", err
+		}
+	}
+	return mappedDevice, nil
+}
+
+// encryptedBackingDevice The device an open LUKS mapping sits on according to cryptsetup status, empty if it's gone
+func encryptedBackingDevice(ctx context.Context, name string) (string, error) {
+	out, err := runCryptsetup(ctx, nil, "status", name)
+	if err != nil {
+		return "", fmt.Errorf("cryptsetup status failed: %w: %s", err, strings.TrimSpace(out))
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if key, value, found := strings.Cut(strings.TrimSpace(line), ":"); found && key == "device" {
+			if value = strings.TrimSpace(value); value == "(null)" {
+				return "", nil
+			}
+			return value, nil
+		}
+	}
+	return "", nil
+}
+
+// sameDevice Whether both paths are the same device node, following symlinks like /dev/disk/by-id
+func sameDevice(a string, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	if resolved, err := filepath.EvalSymlinks(a); err == nil {
+		a = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(b); err == nil {
+		b = resolved
+	}
+	return filepath.Clean(a) == filepath.Clean(b)
+}
+
+// isEncryptedVolumeInUse Whether the mapping of a volume is still mounted, i.e. published at another target on
+// this node
+func isEncryptedVolumeInUse(volumeId string) (bool, error) {
+	mappedDevice := encryptedDevice(volumeId)
+	if _, err := os.Stat(mappedDevice); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return isDeviceMounted(mappedDevice)
+}
+
+// closeEncryptedVolume Close the LUKS mapping of a volume if it's open. A mapping that's still busy is an error, the
+// disk must not be detached from under it
+func closeEncryptedVolume(ctx context.Context, volumeId string) error {
+	name := encryptedMappingName(volumeId)
+	if _, err := os.Stat(encryptedDevice(volumeId)); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	out, err := runCryptsetup(ctx, nil, "close", name)
+	if exitCode(err) == cryptsetupBusy {
+		klog.ErrorS(err, "encrypted volume still in use", "pv", volumeId, "output", out)
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("encrypted volume %s is still in use", volumeId))
+	}
+	if err != nil {
+		klog.ErrorS(err, "couldn't close encrypted volume", "pv", volumeId, "output", out)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeDeviceMapper Empty device mapper directory for mappings of the tests
+func fakeDeviceMapper(t *testing.T) {
+	previous := deviceMapperDir
+	deviceMapperDir = t.TempDir()
+	t.Cleanup(func() { deviceMapperDir = previous })
+}
+
+// fakeMapping An open mapping of the test volume, cryptsetup status reports it on backingDevice and close exits with
+// the given code
+func fakeMapping(t *testing.T, backingDevice string, close int) *[]string {
+	fakeDeviceMapper(t)
+	assert.Nil(t, os.WriteFile(encryptedDevice(testVolumeId), nil, 0600))
+	return fakeCommands(t, func(name string, args []string) (string, int) {
+		switch {
+		case name != "cryptsetup":
+			return "", 0
+		case args[0] == "status":
+			return "/dev/mapper/luks-" + testVolumeId + " is active and is in use.\n  type:    LUKS2\n  device:  " + backingDevice + "\n  mode:    read/write\n", 0
+		case args[0] == "close":
+			return "", close
+		}
+		return "", 0
+	})
+}
+
+// fakeCryptsetup Fake cryptsetup and wipefs. isLuks and the first open exit with the given codes, a second open
+// (with the previous passphrase) succeeds
+func fakeCryptsetup(t *testing.T, isLuks int, open int, signatures string) *[]string {
+	fakeDeviceMapper(t)
+
+	opens := 0
+	return fakeCommands(t, func(name string, args []string) (string, int) {
+		switch {
+		case name == "wipefs":
+			return signatures, 0
+		case args[0] == "isLuks":
+			return "", isLuks
+		case args[0] == "open":
+			opens++
+			if opens == 1 {
+				return "", open
+			}
+		}
+		return "", 0
+	})
+}
+
+func Test_OpenEncryptedVolumeRefusesExistingSignatures(t *testing.T) {
+	commands := fakeCryptsetup(t, cryptsetupNotLuks, 0, `{"signatures":[{"device":"sdb","offset":"0x438","type":"ext4"}]}`)
+	driver := &LibvirtCsiDriver{}
+
+	_, err := driver.openEncryptedVolume(context.Background(), testVolumeId, "/dev/sdb", map[string]string{secretPassphrase: "new"}, false, false)
+
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.False(t, ranCommand(commands, "cryptsetup luksFormat"))
+	assert.True(t, driver.conditions[testVolumeId].Abnormal)
+}
+
+func Test_OpenEncryptedVolumeIsLuksFailure(t *testing.T) {
+	// e.g. the device couldn't be read
+	commands := fakeCryptsetup(t, 4, 0, "")
+	driver := &LibvirtCsiDriver{}
+
+	_, err := driver.openEncryptedVolume(context.Background(), testVolumeId, "/dev/sdb", map[string]string{secretPassphrase: "new"}, true, false)
+
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.False(t, ranCommand(commands, "cryptsetup luksFormat"))
+}
+
+func Test_OpenEncryptedVolumeFormatsBlank(t *testing.T) {
+	commands := fakeCryptsetup(t, cryptsetupNotLuks, 0, "")
+	driver := &LibvirtCsiDriver{}
+
+	device, err := driver.openEncryptedVolume(context.Background(), testVolumeId, "/dev/sdb", map[string]string{secretPassphrase: "new"}, false, false)
+
+	assert.Nil(t, err)
+	assert.Equal(t, deviceMapperDir+"/luks-"+testVolumeId, device)
+	assert.True(t, ranCommand(commands, "cryptsetup luksFormat --type luks2 --batch-mode --key-file=/dev/fd/3 /dev/sdb"))
+}
+
+// fakeRotation Fake cryptsetup for a LUKS volume with the test passphrases "new" and "old", opening with "new" exits
+// with the given code. --test-passphrase exits with the given codes for the previous and the current passphrase, in
+// that order. luksAddKey and luksRemoveKey exit with the given codes
+func fakeRotation(t *testing.T, open int, previous int, current int, addKey int, removeKey int) *[]string {
+	fakeDeviceMapper(t)
+	opens := 0
+	tests := []int{previous, current}
+	return fakeCommands(t, func(name string, args []string) (string, int) {
+		switch {
+		case args[0] == "open" && args[3] == "--test-passphrase":
+			code := tests[0]
+			tests = tests[1:]
+			return "", code
+		case args[0] == "open":
+			opens++
+			if opens == 1 {
+				return "", open
+			}
+		case args[0] == "luksAddKey":
+			return "", addKey
+		case args[0] == "luksRemoveKey":
+			return "", removeKey
+		}
+		return "", 0
+	})
+}
+
+func Test_OpenEncryptedVolumePreviousPassphrase(t *testing.T) {
+	commands := fakeRotation(t, cryptsetupWrongKey, 0, cryptsetupWrongKey, 0, 0)
+	driver := &LibvirtCsiDriver{}
+	secrets := map[string]string{secretPassphrase: "new", secretPreviousPassphrase: "old"}
+
+	_, err := driver.openEncryptedVolume(context.Background(), testVolumeId, "/dev/sdb", secrets, false, false)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"cryptsetup isLuks /dev/sdb",
+		"cryptsetup open --type luks --key-file=/dev/fd/3 /dev/sdb luks-" + testVolumeId,
+		"cryptsetup open --type luks --key-file=/dev/fd/3 /dev/sdb luks-" + testVolumeId,
+		"cryptsetup open --type luks --test-passphrase --key-file=/dev/fd/3 /dev/sdb",
+		"cryptsetup open --type luks --test-passphrase --key-file=/dev/fd/3 /dev/sdb",
+		"cryptsetup luksAddKey --batch-mode --key-file=/dev/fd/3 /dev/sdb /dev/fd/4",
+		"cryptsetup luksRemoveKey --batch-mode --key-file=/dev/fd/3 /dev/sdb",
+	}, *commands)
+}
+
+func Test_OpenEncryptedVolumeRotation(t *testing.T) {
+	secrets := map[string]string{secretPassphrase: "new", secretPreviousPassphrase: "old"}
+	for _, test := range []struct {
+		name      string
+		previous  int
+		current   int
+		removeKey int
+		added     bool
+		removed   bool
+		errorCode codes.Code
+	}{
+		{"already rotated", cryptsetupWrongKey, 0, 0, false, false, codes.OK},
+		// An earlier publish added the new key and couldn't remove the old one
+		{"previous key left over", 0, 0, 0, false, true, codes.OK},
+		{"previous key not removed", 0, 0, 1, false, true, codes.Internal},
+		{"test failure", 4, 0, 0, false, false, codes.Internal},
+	} {
+		commands := fakeRotation(t, 0, test.previous, test.current, 0, test.removeKey)
+		driver := &LibvirtCsiDriver{}
+
+		_, err := driver.openEncryptedVolume(context.Background(), testVolumeId, "/dev/sdb", secrets, false, false)
+
+		assert.Equal(t, test.errorCode, status.Code(err), test.name)
+		assert.Equal(t, test.added, ranCommand(commands, "cryptsetup luksAddKey"), test.name)
+		assert.Equal(t, test.removed, ranCommand(commands, "cryptsetup luksRemoveKey"), test.name)
+	}
+}
+
+func Test_OpenEncryptedVolumeRotationReadOnly(t *testing.T) {
+	commands := fakeRotation(t, 0, 0, 0, 0, 0)
+	driver := &LibvirtCsiDriver{}
+	secrets := map[string]string{secretPassphrase: "new", secretPreviousPassphrase: "old"}
+
+	_, err := driver.openEncryptedVolume(context.Background(), testVolumeId, "/dev/sdb", secrets, false, true)
+
+	assert.Nil(t, err)
+	assert.False(t, ranCommand(commands, "cryptsetup open --type luks --test-passphrase"))
+}
+
+func Test_OpenEncryptedVolumeAlreadyOpenRotation(t *testing.T) {
+	// The mapping was opened by a publish that failed to remove the previous key
+	commands := fakeMapping(t, "/dev/sdb", 0)
+	driver := &LibvirtCsiDriver{}
+	secrets := map[string]string{secretPassphrase: "new", secretPreviousPassphrase: "old"}
+
+	_, err := driver.openEncryptedVolume(context.Background(), testVolumeId, "/dev/sdb", secrets, false, false)
+
+	assert.Nil(t, err)
+	assert.True(t, ranCommand(commands, "cryptsetup luksRemoveKey --batch-mode --key-file=/dev/fd/3 /dev/sdb"))
+	assert.False(t, ranCommand(commands, "cryptsetup open --type luks --key-file"))
+}
+
+func Test_OpenEncryptedVolumeWrongPassphrase(t *testing.T) {
+	fakeCryptsetup(t, 0, cryptsetupWrongKey, "")
+	driver := &LibvirtCsiDriver{}
+
+	_, err := driver.openEncryptedVolume(context.Background(), testVolumeId, "/dev/sdb", map[string]string{secretPassphrase: "new"}, false, false)
+
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func Test_OpenEncryptedVolumeAlreadyOpen(t *testing.T) {
+	commands := fakeMapping(t, "/dev/sdb", 0)
+	driver := &LibvirtCsiDriver{}
+
+	device, err := driver.openEncryptedVolume(context.Background(), testVolumeId, "/dev/sdb", map[string]string{secretPassphrase: "new"}, false, false)
+
+	assert.Nil(t, err)
+	assert.Equal(t, encryptedDevice(testVolumeId), device)
+	assert.Equal(t, []string{"cryptsetup status luks-" + testVolumeId}, *commands)
+}
+
+func Test_OpenEncryptedVolumeStaleMapping(t *testing.T) {
+	for _, backingDevice := range []string{"/dev/sdc", "(null)"} {
+		commands := fakeMapping(t, backingDevice, 0)
+		driver := &LibvirtCsiDriver{}
+
+		_, err := driver.openEncryptedVolume(context.Background(), testVolumeId, "/dev/sdb", map[string]string{secretPassphrase: "new"}, false, false)
+
+		assert.Nil(t, err, backingDevice)
+		assert.Equal(t, []string{
+			"cryptsetup status luks-" + testVolumeId,
+			"cryptsetup close luks-" + testVolumeId,
+			"cryptsetup isLuks /dev/sdb",
+			"cryptsetup open --type luks --key-file=/dev/fd/3 /dev/sdb luks-" + testVolumeId,
+		}, *commands, backingDevice)
+	}
+}
+
+func Test_OpenEncryptedVolumeStaleMappingBusy(t *testing.T) {
+	commands := fakeMapping(t, "/dev/sdc", cryptsetupBusy)
+	driver := &LibvirtCsiDriver{}
+
+	_, err := driver.openEncryptedVolume(context.Background(), testVolumeId, "/dev/sdb", map[string]string{secretPassphrase: "new"}, false, false)
+
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.False(t, ranCommand(commands, "cryptsetup open"))
+}
+
+func Test_NodeUnpublishVolumeEncrypted(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		mounted   bool
+		close     int
+		closed    bool
+		errorCode codes.Code
+	}{
+		{"closed", false, 0, true, codes.OK},
+		{"busy", false, cryptsetupBusy, true, codes.FailedPrecondition},
+		{"published at another target", true, 0, false, codes.OK},
+	} {
+		commands := fakeMapping(t, "/dev/sdb", test.close)
+		mountInfo := ""
+		if test.mounted {
+			mountInfo = "98 22 253:0 / /var/lib/kubelet/pods/abc/volumes/kubernetes.io~csi/pv/mount rw - ext4 " + encryptedDevice(testVolumeId) + " rw\n"
+		}
+		fakeMountInfo(t, mountInfo)
+		driver := &LibvirtCsiDriver{}
+
+		_, err := driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   testVolumeId,
+			TargetPath: filepath.Join(t.TempDir(), "mount"),
+		})
+
+		assert.Equal(t, test.errorCode, status.Code(err), test.name)
+		assert.Equal(t, test.closed, ranCommand(commands, "cryptsetup close luks-"+testVolumeId), test.name)
+	}
+}
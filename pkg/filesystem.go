@@ -0,0 +1,185 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const defaultFilesystem = "ext4"
+
+// StorageClass parameters tuning mkfs and mounting. They're copied to the VolumeContext under the same keys so the
+// node sees them when it formats and mounts the volume
+const parameterMkfsBlockSize = "mkfsBlockSize"
+const parameterMkfsInodeRatio = "mkfsInodeRatio"
+const parameterMkfsReflink = "mkfsReflink"
+const parameterMkfsLabel = "mkfsLabel"
+const parameterMountOptions = "mountOptions"
+const parameterFsck = "fsck"
+
+var supportedFilesystems = map[string]struct{}{
+	"ext4":  {},
+	"xfs":   {},
+	"btrfs": {},
+}
+
+// Longest label each filesystem accepts
+var filesystemLabelLength = map[string]int{
+	"ext4":  16,
+	"xfs":   12,
+	"btrfs": 255,
+}
+
+var filesystemLabelRegex = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+var mountOptionRegex = regexp.MustCompile(`^[A-Za-z0-9._=:/-]+$`)
+
+type filesystemOptions struct {
+	BlockSize    int64
+	InodeRatio   int64
+	Reflink      *bool
+	Label        string
+	MountOptions []string
+	Fsck         string
+}
+
+func validateFilesystem(fsType string) error {
+	if _, ok := supportedFilesystems[fsType]; !ok {
+		return fmt.Errorf("filesystem %q isn't supported", fsType)
+	}
+	return nil
+}
+
+// capabilityFilesystem Filesystem the volume capability asks for, otherwise the fsType parameter (from the
+// StorageClass or VolumeContext) or the default
+func capabilityFilesystem(capability *csi.VolumeCapability, parameters map[string]string) string {
+	if fsType := capability.GetMount().GetFsType(); fsType != "" {
+		return fsType
+	}
+	if fsType := parameters[parameterFsType]; fsType != "" {
+		return fsType
+	}
+	return defaultFilesystem
+}
+
+// parseFilesystemOptions Read and validate the mkfs and mount parameters for fsType. Unrelated keys are ignored
+func parseFilesystemOptions(fsType string, parameters map[string]string) (*filesystemOptions, error) {
+	if err := validateFilesystem(fsType); err != nil {
+		return nil, err
+	}
+	options := &filesystemOptions{}
+
+	if value, ok := parameters[parameterMkfsBlockSize]; ok && value != "" {
+		blockSize, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || blockSize < 512 || blockSize > 65536 || blockSize&(blockSize-1) != 0 {
+			return nil, fmt.Errorf("%s must be a power of 2 between 512 and 65536, got %q", parameterMkfsBlockSize, value)
+		}
+		options.BlockSize = blockSize
+	}
+
+	if value, ok := parameters[parameterMkfsInodeRatio]; ok && value != "" {
+		if fsType != "ext4" {
+			return nil, fmt.Errorf("%s is only supported for ext4", parameterMkfsInodeRatio)
+		}
+		inodeRatio, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || inodeRatio < 1024 || inodeRatio > 64*1024*1024 {
+			return nil, fmt.Errorf("%s must be between 1024 and 67108864 bytes, got %q", parameterMkfsInodeRatio, value)
+		}
+		options.InodeRatio = inodeRatio
+	}
+
+	if value, ok := parameters[parameterMkfsReflink]; ok && value != "" {
+		if fsType != "xfs" {
+			return nil, fmt.Errorf("%s is only supported for xfs", parameterMkfsReflink)
+		}
+		reflink, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", parameterMkfsReflink, value)
+		}
+		options.Reflink = &reflink
+	}
+
+	if value, ok := parameters[parameterMkfsLabel]; ok && value != "" {
+		if !filesystemLabelRegex.MatchString(value) || len(value) > filesystemLabelLength[fsType] {
+			return nil, fmt.Errorf("%s must be at most %d letters, digits, '.', '_' or '-' for %s, got %q", parameterMkfsLabel, filesystemLabelLength[fsType], fsType, value)
+		}
+		options.Label = value
+	}
+
+	if value, ok := parameters[parameterMountOptions]; ok && value != "" {
+		for _, option := range strings.Split(value, ",") {
+			if !mountOptionRegex.MatchString(option) {
+				return nil, fmt.Errorf("invalid mount option %q in %s", option, parameterMountOptions)
+			}
+			options.MountOptions = append(options.MountOptions, option)
+		}
+	}
+
+	if value, ok := parameters[parameterFsck]; ok && value != "" {
+		if _, ok := fsckModes[value]; !ok {
+			return nil, fmt.Errorf("%s must be one of %s, %s or %s, got %q", parameterFsck, fsckNone, fsckCheck, fsckRepair, value)
+		}
+		options.Fsck = value
+	}
+
+	return options, nil
+}
+
+// volumeContext Options in the form parseFilesystemOptions reads them
+func (o *filesystemOptions) volumeContext() map[string]string {
+	volumeContext := map[string]string{}
+	if o.BlockSize > 0 {
+		volumeContext[parameterMkfsBlockSize] = strconv.FormatInt(o.BlockSize, 10)
+	}
+	if o.InodeRatio > 0 {
+		volumeContext[parameterMkfsInodeRatio] = strconv.FormatInt(o.InodeRatio, 10)
+	}
+	if o.Reflink != nil {
+		volumeContext[parameterMkfsReflink] = strconv.FormatBool(*o.Reflink)
+	}
+	if o.Label != "" {
+		volumeContext[parameterMkfsLabel] = o.Label
+	}
+	if len(o.MountOptions) > 0 {
+		volumeContext[parameterMountOptions] = strings.Join(o.MountOptions, ",")
+	}
+	if o.Fsck != "" {
+		volumeContext[parameterFsck] = o.Fsck
+	}
+	return volumeContext
+}
+
+// mkfsArgs Arguments for mkfs to create fsType on device
+func (o *filesystemOptions) mkfsArgs(fsType string, device string) []string {
+	args := []string{"-t", fsType}
+
+	switch fsType {
+	case "ext4":
+		if o.BlockSize > 0 {
+			args = append(args, "-b", strconv.FormatInt(o.BlockSize, 10))
+		}
+		if o.InodeRatio > 0 {
+			args = append(args, "-i", strconv.FormatInt(o.InodeRatio, 10))
+		}
+	case "xfs":
+		if o.BlockSize > 0 {
+			args = append(args, "-b", fmt.Sprintf("size=%d", o.BlockSize))
+		}
+		if o.Reflink != nil && *o.Reflink {
+			args = append(args, "-m", "reflink=1")
+		} else if o.Reflink != nil {
+			args = append(args, "-m", "reflink=0")
+		}
+	case "btrfs":
+		if o.BlockSize > 0 {
+			args = append(args, "--sectorsize", strconv.FormatInt(o.BlockSize, 10))
+		}
+	}
+
+	if o.Label != "" {
+		args = append(args, "-L", o.Label)
+	}
+
+	return append(args, device)
+}
@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_ParseFilesystemOptionsExt4(t *testing.T) {
+	options, err := parseFilesystemOptions("ext4", map[string]string{
+		parameterMkfsBlockSize:  "4096",
+		parameterMkfsInodeRatio: "65536",
+		parameterMkfsLabel:      "data",
+		parameterMountOptions:   "noatime,commit=60",
+		"volumeGroup":           "vg0",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"-t", "ext4", "-b", "4096", "-i", "65536", "-L", "data", "/dev/sdb1"}, options.mkfsArgs("ext4", "/dev/sdb1"))
+	assert.Equal(t, []string{"noatime", "commit=60"}, options.MountOptions)
+	assert.Equal(t, map[string]string{
+		parameterMkfsBlockSize:  "4096",
+		parameterMkfsInodeRatio: "65536",
+		parameterMkfsLabel:      "data",
+		parameterMountOptions:   "noatime,commit=60",
+	}, options.volumeContext())
+}
+
+func Test_ParseFilesystemOptionsXfsReflink(t *testing.T) {
+	options, err := parseFilesystemOptions("xfs", map[string]string{parameterMkfsReflink: "true"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"-t", "xfs", "-m", "reflink=1", "/dev/sdb1"}, options.mkfsArgs("xfs", "/dev/sdb1"))
+}
+
+func Test_ParseFilesystemOptionsInvalid(t *testing.T) {
+	for name, testCase := range map[string]struct {
+		fsType     string
+		parameters map[string]string
+	}{
+		"unsupported filesystem": {"ntfs", nil},
+		"reflink on ext4":        {"ext4", map[string]string{parameterMkfsReflink: "true"}},
+		"inode ratio on xfs":     {"xfs", map[string]string{parameterMkfsInodeRatio: "16384"}},
+		"block size":             {"ext4", map[string]string{parameterMkfsBlockSize: "3000"}},
+		"label too long":         {"xfs", map[string]string{parameterMkfsLabel: "thirteenchars"}},
+		"mount option":           {"ext4", map[string]string{parameterMountOptions: "noatime,,ro"}},
+	} {
+		_, err := parseFilesystemOptions(testCase.fsType, testCase.parameters)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func Test_ParseFilesystemOptionsFsck(t *testing.T) {
+	options, err := parseFilesystemOptions("xfs", map[string]string{parameterFsck: fsckRepair})
+	assert.Nil(t, err)
+	assert.Equal(t, fsckRepair, options.volumeContext()[parameterFsck])
+
+	_, err = parseFilesystemOptions("xfs", map[string]string{parameterFsck: "always"})
+	assert.NotNil(t, err)
+}
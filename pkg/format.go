@@ -0,0 +1,222 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StorageClass parameter putting the filesystem in a partition instead of on the whole disk. Volumes created before
+// this existed are all partitioned and don't have it in their VolumeContext
+const parameterPartitioned = "partitioned"
+
+// signature Entry of wipefs --json output
+type signature struct {
+	Device string `json:"device"`
+	Offset string `json:"offset"`
+	Type   string `json:"type"`
+}
+
+func (s signature) String() string {
+	return fmt.Sprintf("%s@%s on %s", s.Type, s.Offset, s.Device)
+}
+
+// listSignatures Every filesystem, RAID, LVM and partition table signature wipefs finds on the device itself
+// (not its partitions)
+func listSignatures(ctx context.Context, device string) ([]signature, error) {
+	out, err := execCommand(ctx, "wipefs", "--no-act", "--json", device).Output()
+	if err != nil {
+		klog.ErrorS(err, "couldn't probe device signatures", "device", device, "output", string(out))
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(out))) == 0 {
+		return nil, nil
+	}
+
+	var result struct {
+		Signatures []signature `json:"signatures"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, err
+	}
+	return result.Signatures, nil
+}
+
+// probeFilesystem Filesystem type blkid finds with a low-level superblock probe, bypassing its cache. Empty if
+// there's nothing recognizable. An ambivalent result (several filesystems) is reported as an error
+func probeFilesystem(ctx context.Context, device string) (string, error) {
+	out, err := execCommand(ctx, "blkid", "-p", "-o", "value", "-s", "TYPE", device).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+		// Nothing found
+		return "", nil
+	}
+	if err != nil {
+		klog.ErrorS(err, "couldn't probe filesystem", "device", device, "output", string(out))
+		return "", fmt.Errorf("couldn't probe filesystem on %s: %w", device, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// listPartitions Partition devices of a disk according to sysfs, e.g. /dev/sdb1 or /dev/nvme0n1p1
+func listPartitions(device string) []string {
+	name := filepath.Base(device)
+	entries, err := os.ReadDir(filepath.Join(sysBlockDir, name))
+	if err != nil {
+		return nil
+	}
+
+	var partitions []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), name) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(sysBlockDir, name, entry.Name(), "partition")); err == nil {
+			partitions = append(partitions, filepath.Join(filepath.Dir(device), entry.Name()))
+		}
+	}
+	sort.Strings(partitions)
+	return partitions
+}
+
+// partitionPath Device name of a partition, e.g. /dev/sdb1 but /dev/nvme0n1p1
+func partitionPath(device string, number int) string {
+	if last := device[len(device)-1]; last >= '0' && last <= '9' {
+		return fmt.Sprintf("%sp%d", device, number)
+	}
+	return fmt.Sprintf("%s%d", device, number)
+}
+
+// isPartitioned Whether a volume that's still blank should get a partition table
+func isPartitioned(volumeContext map[string]string) bool {
+	return volumeContext[parameterPartitioned] != "false"
+}
+
+// isPartitionTable Check whether the signatures are only a GPT label (with its protective MBR)
+func isPartitionTable(signatures []signature) bool {
+	for _, sig := range signatures {
+		if sig.Type != "gpt" && sig.Type != "PMBR" {
+			return false
+		}
+	}
+	return len(signatures) > 0
+}
+
+// waitForDevice Wait for udev to create a device node, e.g. after partitioning
+func waitForDevice(ctx context.Context, device string) error {
+	ctx, cancel := context.WithTimeout(ctx, deviceDiscoveryTimeout)
+	defer cancel()
+	for {
+		if _, err := os.Stat(device); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return status.Error(codes.DeadlineExceeded, fmt.Sprintf("device %s didn't appear", device))
+		case <-time.After(deviceDiscoveryInterval):
+		}
+	}
+}
+
+// prepareFilesystem Make sure the volume has a filesystem and return the device to mount and its filesystem type,
+// which may differ from the requested one for existing volumes. The existing layout is detected, either a filesystem
+// on the whole disk or a GPT label with a single partition holding it. Blank disks are set up with the layout the
+// volume was created with. Anything else is only wiped if the volume is fresh (see isFreshVolume), otherwise the
+// volume is flagged abnormal and left alone
+func (s *LibvirtCsiDriver) prepareFilesystem(ctx context.Context, volumeId string, devicePath string, fsType string, fsOptions *filesystemOptions, fresh bool, partitioned bool, readOnly bool) (string, string, error) {
+	diskSignatures, err := listSignatures(ctx, devicePath)
+	if err != nil {
+		return "", "", err
+	}
+	partitions := listPartitions(devicePath)
+	existing := append([]signature{}, diskSignatures...)
+	for _, partition := range partitions {
+		partitionSignatures, err := listSignatures(ctx, partition)
+		if err != nil {
+			return "", "", err
+		}
+		existing = append(existing, partitionSignatures...)
+	}
+
+	// Already set up, possibly by an earlier publish
+	var existingDevice string
+	switch {
+	case len(diskSignatures) == 1 && len(partitions) == 0:
+		existingDevice = devicePath
+	case isPartitionTable(diskSignatures) && len(partitions) == 1 && len(existing) == len(diskSignatures)+1:
+		existingDevice = partitions[0]
+	}
+	if existingDevice != "" {
+		existingFsType, err := probeFilesystem(ctx, existingDevice)
+		if err != nil {
+			return "", "", err
+		}
+		if _, ok := supportedFilesystems[existingFsType]; ok {
+			if existingFsType != fsType {
+				klog.InfoS("volume has a different filesystem than requested", "pv", volumeId, "fsType", existingFsType, "requestedFsType", fsType)
+			}
+			s.setVolumeCondition(volumeId, nil)
+			return existingDevice, existingFsType, nil
+		}
+	}
+
+	if len(existing) > 0 {
+		signatures := make([]string, 0, len(existing))
+		for _, sig := range existing {
+			signatures = append(signatures, sig.String())
+		}
+		if !fresh {
+			message := fmt.Sprintf("refusing to format volume %s with existing signatures: %s", volumeId, strings.Join(signatures, ", "))
+			klog.ErrorS(nil, message, "pv", volumeId, "device", devicePath)
+			s.setVolumeCondition(volumeId, &csi.VolumeCondition{Abnormal: true, Message: message})
+			return "", "", status.Error(codes.FailedPrecondition, message)
+		}
+		if readOnly {
+			return "", "", status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %s needs to be wiped and is published read-only", volumeId))
+		}
+
+		klog.InfoS("wiping stale signatures from fresh volume", "pv", volumeId, "signatures", signatures)
+		for _, device := range append(partitions, devicePath) {
+			if out, err := execCommand(ctx, "wipefs", "--all", device).CombinedOutput(); err != nil {
+				klog.ErrorS(err, "couldn't wipe signatures", "device", device, "output", string(out))
+				return "", "", err
+			}
+		}
+	}
+
+	if readOnly {
+		return "", "", status.Error(codes.FailedPrecondition, fmt.Sprintf("volume %s isn't formatted and is published read-only", volumeId))
+	}
+
+	fsDevice := devicePath
+	if partitioned {
+		klog.InfoS("partitioning pv", "pv", volumeId)
+		shellCommand := []string{devicePath, "--script", "-a", "optimal", "mklabel", "gpt", "mkpart", "primary", fsType, "0%", "100%"}
+		if out, partErr := execCommand(ctx, "parted", shellCommand...).CombinedOutput(); partErr != nil {
+			klog.ErrorS(partErr, "failed to partition disk", "command", shellCommand, "output", string(out))
+			return "", "", partErr
+		}
+		fsDevice = partitionPath(devicePath, 1)
+		if err := waitForDevice(ctx, fsDevice); err != nil {
+			return "", "", err
+		}
+	}
+
+	klog.InfoS("formatting pv", "pv", volumeId, "fsType", fsType, "device", fsDevice)
+	if out, err := execCommand(ctx, "mkfs", fsOptions.mkfsArgs(fsType, fsDevice)...).CombinedOutput(); err != nil {
+		klog.ErrorS(err, "couldn't format volume", "fsType", fsType, "device", fsDevice, "output", string(out))
+		return "", "", err
+	}
+
+	s.setVolumeCondition(volumeId, nil)
+	return fsDevice, fsType, nil
+}
@@ -0,0 +1,123 @@
+package pkg
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeCommands Replace the tools the node plugin runs. The handler returns the output and exit code of a command,
+// the commands run are returned as "name arg..." lines
+func fakeCommands(t *testing.T, handler func(name string, args []string) (string, int)) *[]string {
+	previous := execCommand
+	t.Cleanup(func() { execCommand = previous })
+
+	commands := &[]string{}
+	execCommand = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		*commands = append(*commands, strings.Join(append([]string{name}, args...), " "))
+		output, exitCode := handler(name, args)
+		cmd := exec.CommandContext(ctx, "sh", "-c", `printf '%s' "$FAKE_OUTPUT"; exit "$FAKE_EXIT_CODE"`)
+		cmd.Env = []string{"FAKE_OUTPUT=" + output, "FAKE_EXIT_CODE=" + strconv.Itoa(exitCode)}
+		return cmd
+	}
+	return commands
+}
+
+// ranCommand Whether one of the commands starts with prefix
+func ranCommand(commands *[]string, prefix string) bool {
+	for _, command := range *commands {
+		if strings.HasPrefix(command, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func Test_ListPartitions(t *testing.T) {
+	fakeDeviceTree(t)
+	for _, partition := range []string{"nvme0n1p1", "nvme0n1p2"} {
+		assert.Nil(t, os.MkdirAll(filepath.Join(sysBlockDir, "nvme0n1", partition), 0755))
+		assert.Nil(t, os.WriteFile(filepath.Join(sysBlockDir, "nvme0n1", partition, "partition"), []byte("1\n"), 0644))
+	}
+	assert.Nil(t, os.MkdirAll(filepath.Join(sysBlockDir, "nvme0n1", "queue"), 0755))
+
+	assert.Equal(t, []string{"/dev/nvme0n1p1", "/dev/nvme0n1p2"}, listPartitions("/dev/nvme0n1"))
+	assert.Empty(t, listPartitions("/dev/sdb"))
+}
+
+func Test_IsPartitionTable(t *testing.T) {
+	assert.True(t, isPartitionTable([]signature{{Type: "gpt"}, {Type: "PMBR"}}))
+	assert.False(t, isPartitionTable([]signature{{Type: "gpt"}, {Type: "LVM2_member"}}))
+	assert.False(t, isPartitionTable([]signature{{Type: "dos"}}))
+	assert.False(t, isPartitionTable(nil))
+}
+
+func Test_PartitionPath(t *testing.T) {
+	assert.Equal(t, "/dev/sdb1", partitionPath("/dev/sdb", 1))
+	assert.Equal(t, "/dev/vdc2", partitionPath("/dev/vdc", 2))
+	assert.Equal(t, "/dev/nvme0n1p1", partitionPath("/dev/nvme0n1", 1))
+}
+
+func Test_IsPartitioned(t *testing.T) {
+	assert.True(t, isPartitioned(map[string]string{}))
+	assert.True(t, isPartitioned(map[string]string{parameterPartitioned: "true"}))
+	assert.False(t, isPartitioned(map[string]string{parameterPartitioned: "false"}))
+}
+
+func Test_PrepareFilesystemRepublishFreshVolume(t *testing.T) {
+	root := fakeDeviceTree(t)
+	fakeDisk(t, root, "sdb", "scsi-0QEMU_QEMU_HARDDISK_a61a74d2ab75458bbf1b0216923ca686")
+	file := filepath.Join(t.TempDir(), "used-volumes.json")
+	driver := &LibvirtCsiDriver{UsedVolumesFile: file}
+	publishContext := map[string]string{publishContextFresh: "true"}
+	fsOptions, _ := parseFilesystemOptions("ext4", nil)
+
+	// First publish, the stale signature is wiped
+	signatures := `{"signatures":[{"device":"sdb","offset":"0x438","type":"ext3"}]}`
+	commands := fakeCommands(t, func(name string, args []string) (string, int) {
+		if name == "wipefs" && args[0] == "--no-act" {
+			return signatures, 0
+		}
+		return "", 0
+	})
+	fresh := driver.isFreshVolume(testVolumeId, publishContext)
+	assert.True(t, fresh)
+	_, _, err := driver.prepareFilesystem(context.Background(), testVolumeId, "/dev/sdb", "ext4", fsOptions, fresh, false, false)
+	assert.Nil(t, err)
+	assert.True(t, ranCommand(commands, "wipefs --all /dev/sdb"))
+	assert.True(t, ranCommand(commands, "mkfs -t ext4"))
+	assert.Nil(t, driver.markVolumeUsed(testVolumeId))
+
+	// The workload put something unrecognized on it, the next publish with the same PublishContext leaves it alone,
+	// also after a restart
+	signatures = `{"signatures":[{"device":"sdb","offset":"0x36","type":"vfat"}]}`
+	for _, publisher := range []*LibvirtCsiDriver{driver, {UsedVolumesFile: file}} {
+		*commands = nil
+		fresh = publisher.isFreshVolume(testVolumeId, publishContext)
+		assert.False(t, fresh)
+		_, _, err = publisher.prepareFilesystem(context.Background(), testVolumeId, "/dev/sdb", "ext4", fsOptions, fresh, false, false)
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.False(t, ranCommand(commands, "wipefs --all"))
+		assert.False(t, ranCommand(commands, "mkfs"))
+	}
+}
+
+func Test_IsFreshVolume(t *testing.T) {
+	fakeDeviceTree(t)
+	driver := &LibvirtCsiDriver{UsedVolumesFile: filepath.Join(t.TempDir(), "used-volumes.json")}
+
+	assert.False(t, driver.isFreshVolume(testVolumeId, map[string]string{}))
+	assert.True(t, driver.isFreshVolume(testVolumeId, map[string]string{publishContextFresh: "true"}))
+
+	// An unreadable record counts every volume as used
+	assert.Nil(t, os.WriteFile(driver.UsedVolumesFile, []byte("{"), 0600))
+	restarted := &LibvirtCsiDriver{UsedVolumesFile: driver.UsedVolumesFile}
+	assert.False(t, restarted.isFreshVolume(testVolumeId, map[string]string{publishContextFresh: "true"}))
+}
@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"k8s.io/klog/v2"
+	"os"
+	"sort"
+)
+
+// isFreshVolume Whether anything found on the volume is left over from whatever previously used the space and safe
+// to wipe. The controller only says so on the volume's first attach, and the PublishContext of that attach is reused
+// for every publish until the volume is detached, so volumes this node already set up are never fresh again
+func (s *LibvirtCsiDriver) isFreshVolume(volumeId string, publishContext map[string]string) bool {
+	if publishContext[publishContextFresh] != "true" {
+		return false
+	}
+
+	s.usedLock.Lock()
+	defer s.usedLock.Unlock()
+	s.loadUsedVolumes()
+	_, used := s.used[volumeId]
+	return !used && !s.usedUnknown
+}
+
+// markVolumeUsed Remember the volume was set up on this node, before anything can write to it. Volumes no longer
+// attached are forgotten, they can't be fresh again since the controller only hands out fresh on the first attach
+func (s *LibvirtCsiDriver) markVolumeUsed(volumeId string) error {
+	s.usedLock.Lock()
+	defer s.usedLock.Unlock()
+
+	s.loadUsedVolumes()
+	if _, ok := s.used[volumeId]; ok {
+		return nil
+	}
+	for used := range s.used {
+		if devices, err := scanVolumeDevices(used); err == nil && len(devices) == 0 {
+			delete(s.used, used)
+		}
+	}
+	s.used[volumeId] = struct{}{}
+	if s.UsedVolumesFile == "" || s.usedUnknown {
+		return nil
+	}
+
+	volumes := make([]string, 0, len(s.used))
+	for used := range s.used {
+		volumes = append(volumes, used)
+	}
+	sort.Strings(volumes)
+	if err := writeJsonFile(s.UsedVolumesFile, volumes); err != nil {
+		klog.ErrorS(err, "couldn't write used volumes", "file", s.UsedVolumesFile)
+		return fmt.Errorf("couldn't record volume %s as used: %w", volumeId, err)
+	}
+	return nil
+}
+
+// loadUsedVolumes Read the used volumes file once. Must be called with usedLock held. An unreadable file makes every
+// volume count as used and is left for an admin to look at, better refuse to wipe a fresh volume than wipe one in use
+func (s *LibvirtCsiDriver) loadUsedVolumes() {
+	if s.used != nil {
+		return
+	}
+	s.used = make(map[string]struct{})
+	if s.UsedVolumesFile == "" {
+		return
+	}
+
+	var volumes []string
+	err := readJsonFile(s.UsedVolumesFile, &volumes)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		klog.ErrorS(err, "couldn't read used volumes, no volume is considered fresh", "file", s.UsedVolumesFile)
+		s.usedUnknown = true
+	}
+	for _, volumeId := range volumes {
+		s.used[volumeId] = struct{}{}
+	}
+}
@@ -0,0 +1,176 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"os"
+	"os/exec"
+)
+
+// Values of the fsck StorageClass parameter
+const fsckNone = "none"     // Mount without checking (default)
+const fsckCheck = "check"   // Check without changing anything, report problems as a volume condition
+const fsckRepair = "repair" // Fix problems that can be fixed without losing data, refuse to mount otherwise
+
+var fsckModes = map[string]struct{}{
+	fsckNone:   {},
+	fsckCheck:  {},
+	fsckRepair: {},
+}
+
+// fsckResult Outcome of checking a filesystem
+type fsckResult struct {
+	Clean    bool   // No problems left
+	Repaired bool   // Problems were found and fixed
+	Message  string // Summary for the volume condition
+}
+
+// exitCode Exit status of a command that ran, -1 if it couldn't be run at all
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err == nil {
+		return 0
+	}
+	return -1
+}
+
+// runFsck Run a check or repair command, logging its output
+func runFsck(ctx context.Context, volumeId string, command string, args ...string) int {
+	out, err := execCommand(ctx, command, args...).CombinedOutput()
+	code := exitCode(err)
+	klog.InfoS("fsck output", "pv", volumeId, "command", append([]string{command}, args...), "exitCode", code, "output", string(out))
+	return code
+}
+
+// checkExt4 e2fsck exit codes: 0 clean, 1 errors corrected, 2 corrected but reboot suggested, 4 errors left
+// uncorrected, 8 and up operational errors
+func checkExt4(ctx context.Context, volumeId string, device string, repair bool) fsckResult {
+	if !repair {
+		code := runFsck(ctx, volumeId, "e2fsck", "-n", device)
+		if code == 0 {
+			return fsckResult{Clean: true}
+		}
+		return fsckResult{Message: fmt.Sprintf("e2fsck -n found errors (exit status %d)", code)}
+	}
+
+	code := runFsck(ctx, volumeId, "e2fsck", "-p", device)
+	switch {
+	case code == 0:
+		return fsckResult{Clean: true}
+	case code == 1 || code == 2:
+		return fsckResult{Clean: true, Repaired: true, Message: "e2fsck -p corrected filesystem errors"}
+	default:
+		return fsckResult{Message: fmt.Sprintf("e2fsck -p couldn't correct filesystem errors (exit status %d)", code)}
+	}
+}
+
+// replayXfsLog Mount and unmount the filesystem so the kernel replays a dirty log. This is the safe alternative to
+// xfs_repair -L, which throws the log away
+func replayXfsLog(ctx context.Context, volumeId string, device string) error {
+	dir, err := os.MkdirTemp("", "libvirt-csi-fsck-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+
+	if out, err := execCommand(ctx, "mount", "-t", "xfs", device, dir).CombinedOutput(); err != nil {
+		klog.ErrorS(err, "couldn't mount xfs to replay its log", "pv", volumeId, "output", string(out))
+		return err
+	}
+	if out, err := execCommand(ctx, "umount", dir).CombinedOutput(); err != nil {
+		klog.ErrorS(err, "couldn't unmount xfs after replaying its log", "pv", volumeId, "output", string(out))
+		return err
+	}
+	return nil
+}
+
+// checkXfs xfs_repair -n exit codes: 0 clean, 1 corruption found, 2 dirty log. A dirty log is normal after a crash
+// and replayed on mount, so only corruption is repaired, after replaying the log
+func checkXfs(ctx context.Context, volumeId string, device string, repair bool) fsckResult {
+	code := runFsck(ctx, volumeId, "xfs_repair", "-n", device)
+	switch {
+	case code == 0:
+		return fsckResult{Clean: true}
+	case code == 2 && !repair:
+		return fsckResult{Clean: true, Message: "xfs log is dirty and will be replayed on mount"}
+	case !repair:
+		return fsckResult{Message: fmt.Sprintf("xfs_repair -n found corruption (exit status %d)", code)}
+	}
+
+	if code == 2 {
+		if err := replayXfsLog(ctx, volumeId, device); err != nil {
+			return fsckResult{Message: fmt.Sprintf("xfs log is dirty and couldn't be replayed: %s", err)}
+		}
+		if code = runFsck(ctx, volumeId, "xfs_repair", "-n", device); code == 0 {
+			return fsckResult{Clean: true}
+		}
+	}
+
+	if code = runFsck(ctx, volumeId, "xfs_repair", device); code != 0 {
+		return fsckResult{Message: fmt.Sprintf("xfs_repair couldn't repair the filesystem (exit status %d)", code)}
+	}
+	return fsckResult{Clean: true, Repaired: true, Message: "xfs_repair repaired filesystem corruption"}
+}
+
+// checkBtrfs btrfs has no safe offline repair, so problems are only reported
+func checkBtrfs(ctx context.Context, volumeId string, device string) fsckResult {
+	if code := runFsck(ctx, volumeId, "btrfs", "check", "--readonly", device); code != 0 {
+		return fsckResult{Message: fmt.Sprintf("btrfs check found errors (exit status %d)", code)}
+	}
+	return fsckResult{Clean: true}
+}
+
+// checkFilesystem Check (and possibly repair) the filesystem before mounting and record the outcome as the
+// volume's condition. Returns an error if the volume shouldn't be mounted
+func (s *LibvirtCsiDriver) checkFilesystem(ctx context.Context, volumeId string, device string, fsType string, mode string, readOnly bool) error {
+	if mode == "" || mode == fsckNone {
+		return nil
+	}
+	// Checking or repairing a mounted filesystem corrupts it. It was checked when it was first mounted
+	if mounted, err := isDeviceMounted(device); err != nil {
+		return err
+	} else if mounted {
+		klog.InfoS("skipping filesystem check, device is already mounted", "pv", volumeId, "device", device)
+		return nil
+	}
+	// A read-only disk can't be repaired
+	repair := mode == fsckRepair && !readOnly
+
+	klog.InfoS("checking filesystem", "pv", volumeId, "device", device, "fsType", fsType, "repair", repair)
+	var result fsckResult
+	switch fsType {
+	case "ext4":
+		result = checkExt4(ctx, volumeId, device, repair)
+	case "xfs":
+		result = checkXfs(ctx, volumeId, device, repair)
+	case "btrfs":
+		result = checkBtrfs(ctx, volumeId, device)
+	default:
+		klog.InfoS("no filesystem check available", "pv", volumeId, "fsType", fsType)
+		return nil
+	}
+
+	if result.Clean {
+		if result.Message != "" {
+			klog.InfoS(result.Message, "pv", volumeId, "repaired", result.Repaired)
+		}
+		s.setVolumeCondition(volumeId, &csi.VolumeCondition{Abnormal: false, Message: result.Message})
+		return nil
+	}
+
+	message := fmt.Sprintf("filesystem check failed for volume %s: %s", volumeId, result.Message)
+	klog.ErrorS(nil, message, "pv", volumeId, "device", device)
+	s.setVolumeCondition(volumeId, &csi.VolumeCondition{Abnormal: true, Message: message})
+	if mode == fsckRepair {
+		return status.Error(codes.FailedPrecondition, message)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+	"testing"
+)
+
+func Test_CheckExt4(t *testing.T) {
+	for _, test := range []struct {
+		exitCode int
+		repair   bool
+		result   fsckResult
+	}{
+		{0, false, fsckResult{Clean: true}},
+		{4, false, fsckResult{Message: "e2fsck -n found errors (exit status 4)"}},
+		{0, true, fsckResult{Clean: true}},
+		{1, true, fsckResult{Clean: true, Repaired: true, Message: "e2fsck -p corrected filesystem errors"}},
+		{2, true, fsckResult{Clean: true, Repaired: true, Message: "e2fsck -p corrected filesystem errors"}},
+		{4, true, fsckResult{Message: "e2fsck -p couldn't correct filesystem errors (exit status 4)"}},
+		{8, true, fsckResult{Message: "e2fsck -p couldn't correct filesystem errors (exit status 8)"}},
+	} {
+		fakeCommands(t, func(name string, args []string) (string, int) { return "", test.exitCode })
+		assert.Equal(t, test.result, checkExt4(context.Background(), testVolumeId, "/dev/sdb", test.repair), "exit status %d, repair %t", test.exitCode, test.repair)
+	}
+}
+
+func Test_CheckXfs(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// Exit codes of xfs_repair -n, in order, and of xfs_repair
+		checks   []int
+		repair   int
+		fix      bool
+		result   fsckResult
+		repaired bool
+	}{
+		{"clean", []int{0}, 0, true, fsckResult{Clean: true}, false},
+		{"dirty log check", []int{2}, 0, false, fsckResult{Clean: true, Message: "xfs log is dirty and will be replayed on mount"}, false},
+		{"corrupt check", []int{1}, 0, false, fsckResult{Message: "xfs_repair -n found corruption (exit status 1)"}, false},
+		{"dirty log replayed", []int{2, 0}, 0, true, fsckResult{Clean: true}, false},
+		{"corrupt repaired", []int{1}, 0, true, fsckResult{Clean: true, Repaired: true, Message: "xfs_repair repaired filesystem corruption"}, true},
+		{"corrupt after replay", []int{2, 1}, 0, true, fsckResult{Clean: true, Repaired: true, Message: "xfs_repair repaired filesystem corruption"}, true},
+		{"unrepairable", []int{1}, 1, true, fsckResult{Message: "xfs_repair couldn't repair the filesystem (exit status 1)"}, true},
+	} {
+		checks := append([]int{}, test.checks...)
+		commands := fakeCommands(t, func(name string, args []string) (string, int) {
+			if name == "xfs_repair" && args[0] == "-n" {
+				code := checks[0]
+				checks = checks[1:]
+				return "", code
+			}
+			if name == "xfs_repair" {
+				return "", test.repair
+			}
+			return "", 0
+		})
+		assert.Equal(t, test.result, checkXfs(context.Background(), testVolumeId, "/dev/sdb", test.fix), test.name)
+		assert.Equal(t, test.repaired, ranCommand(commands, "xfs_repair /dev/sdb"), test.name)
+	}
+}
+
+func Test_CheckFilesystemSkipsMountedDevice(t *testing.T) {
+	fakeMountInfo(t, testMountInfo)
+	commands := fakeCommands(t, func(name string, args []string) (string, int) { return "", 4 })
+	driver := &LibvirtCsiDriver{}
+
+	// Published a second time on the same node, e.g. SINGLE_NODE_MULTI_WRITER
+	assert.Nil(t, driver.checkFilesystem(context.Background(), testVolumeId, "/dev/sdb1", "ext4", fsckRepair, false))
+	assert.Empty(t, *commands)
+
+	err := driver.checkFilesystem(context.Background(), testVolumeId, "/dev/sdc1", "ext4", fsckRepair, false)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Equal(t, "e2fsck -p /dev/sdc1", strings.Join(*commands, ";"))
+}
@@ -0,0 +1,259 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alessio/shellescape"
+	"k8s.io/klog/v2"
+	"regexp"
+	"strings"
+)
+
+// How the controller runs libvirt-storage-attach on the hypervisor
+const HelperModeSudo = "sudo"                    // sudo with command line flags (default)
+const HelperModeForcedCommand = "forced-command" // HelperRequest as JSON on stdin to the authorized_keys command=
+
+// Command requested in forced command mode. sshd runs the forced command instead, this only shows up in its
+// SSH_ORIGINAL_COMMAND
+const forcedCommand = "libvirt-storage-attach -stdin"
+
+// libvirt-storage-attach operations
+const helperOperationList = "list"
+const helperOperationCreate = "create"
+const helperOperationDelete = "delete"
+const helperOperationAttach = "attach"
+const helperOperationDetach = "detach"
+const helperOperationCapacity = "capacity"
+const helperOperationModify = "modify"
+
+var helperVolumeIdRegex = regexp.MustCompile(`^pv-[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// Directory paths, ZFS datasets and Ceph pools. Backends check their own pools more strictly
+var helperPoolRegex = regexp.MustCompile(`^/?[A-Za-z0-9+_.:-]+(/[A-Za-z0-9+_.:-]+)*$`)
+
+// LVM's allowed characters, without a leading '-'
+var helperVolumeGroupRegex = regexp.MustCompile(`^[A-Za-z0-9+_.][A-Za-z0-9+_.-]{0,126}$`)
+
+// A subset of what libvirt accepts as domain names
+var helperVmNameRegex = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,252}$`)
+
+// Fields of the diskTuning settings
+var helperTuningFields = []string{"cache", "io", "discard", "detectZeroes", "totalBytesSec", "totalIopsSec"}
+
+// HelperRequest One libvirt-storage-attach operation. In forced command mode this is sent as JSON on stdin and the
+// helper is expected to check it with Validate too
+type HelperRequest struct {
+	Operation   string `json:"operation"`
+	Backend     string `json:"backend,omitempty"` // Empty for LVM
+	VolumeId    string `json:"pvId,omitempty"`
+	VolumeGroup string `json:"volumeGroup,omitempty"`
+	ThinPool    string `json:"thinPool,omitempty"`
+	Pool        string `json:"pool,omitempty"`
+	ImageFormat string `json:"imageFormat,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	VmName      string `json:"vmName,omitempty"`
+	VmUuid      string `json:"vmUuid,omitempty"`
+	ReadOnly    bool   `json:"readonly,omitempty"`
+	Shareable   bool   `json:"shareable,omitempty"`
+
+	// libvirt <driver> attributes and <iotune> limits for attach, see diskTuning
+	CacheMode     string `json:"cache,omitempty"`
+	IoMode        string `json:"io,omitempty"`
+	Discard       string `json:"discard,omitempty"`
+	DetectZeroes  string `json:"detectZeroes,omitempty"`
+	TotalBytesSec int64  `json:"totalBytesSec,omitempty"`
+	TotalIopsSec  int64  `json:"totalIopsSec,omitempty"`
+}
+
+// Validate Check the request against the schema of its operation. Fields an operation doesn't use must be empty.
+// Every operation takes a backend
+func (r *HelperRequest) Validate() error {
+	var required, allowed []string
+	switch r.Operation {
+	case helperOperationList:
+	case helperOperationCreate:
+		// Without a volume group the helper uses its default one. Shareable and the tuning are stored on the volume
+		required = []string{"size"}
+		allowed = append([]string{"volumeGroup", "thinPool", "pool", "imageFormat", "shareable"}, helperTuningFields...)
+	case helperOperationDelete:
+		required = []string{"pvId"}
+	case helperOperationAttach:
+		required = []string{"pvId", "vm"}
+		allowed = append([]string{"readonly", "shareable"}, helperTuningFields...)
+	case helperOperationDetach:
+		required = []string{"pvId", "vm"}
+	case helperOperationCapacity:
+		allowed = []string{"volumeGroup", "thinPool", "pool"}
+	case helperOperationModify:
+		// Stores the tuning on the volume and applies it to the disks of domains it's attached to
+		required = []string{"pvId"}
+		allowed = helperTuningFields
+	default:
+		return fmt.Errorf("unknown operation %q", r.Operation)
+	}
+
+	present := map[string]bool{
+		"pvId":        r.VolumeId != "",
+		"volumeGroup": r.VolumeGroup != "",
+		"thinPool":    r.ThinPool != "",
+		"pool":        r.Pool != "",
+		"imageFormat": r.ImageFormat != "",
+		"size":        r.Size != 0,
+		"vm":          r.VmName != "" || r.VmUuid != "",
+		"readonly":    r.ReadOnly,
+		"shareable":   r.Shareable,
+
+		"cache":         r.CacheMode != "",
+		"io":            r.IoMode != "",
+		"discard":       r.Discard != "",
+		"detectZeroes":  r.DetectZeroes != "",
+		"totalBytesSec": r.TotalBytesSec != 0,
+		"totalIopsSec":  r.TotalIopsSec != 0,
+	}
+	for _, field := range required {
+		if !present[field] {
+			return fmt.Errorf("%s requires %s", r.Operation, field)
+		}
+		present[field] = false
+	}
+	for _, field := range allowed {
+		present[field] = false
+	}
+	for field, set := range present {
+		if set {
+			return fmt.Errorf("%s doesn't take %s", r.Operation, field)
+		}
+	}
+
+	if _, ok := storageBackends[r.Backend]; r.Backend != "" && !ok {
+		return fmt.Errorf("unknown backend %q", r.Backend)
+	}
+	if r.VolumeId != "" && !helperVolumeIdRegex.MatchString(r.VolumeId) {
+		return fmt.Errorf("invalid volume id %q", r.VolumeId)
+	}
+	if r.Pool != "" && (!helperPoolRegex.MatchString(r.Pool) || strings.Contains(r.Pool, "..")) {
+		return fmt.Errorf("invalid pool %q", r.Pool)
+	}
+	if r.ImageFormat != "" && r.ImageFormat != imageFormatQcow2 && r.ImageFormat != imageFormatRaw {
+		return fmt.Errorf("invalid image format %q", r.ImageFormat)
+	}
+	if r.VolumeGroup != "" && !helperVolumeGroupRegex.MatchString(r.VolumeGroup) {
+		return fmt.Errorf("invalid volume group %q", r.VolumeGroup)
+	}
+	if r.ThinPool != "" && !helperVolumeGroupRegex.MatchString(r.ThinPool) {
+		return fmt.Errorf("invalid thin pool %q", r.ThinPool)
+	}
+	if r.Size < 0 {
+		return fmt.Errorf("invalid size %d", r.Size)
+	}
+	for key, value := range map[string]string{
+		parameterCacheMode:    r.CacheMode,
+		parameterIoMode:       r.IoMode,
+		parameterDiscard:      r.Discard,
+		parameterDetectZeroes: r.DetectZeroes,
+	} {
+		if err := validateTuningMode(key, value); err != nil {
+			return err
+		}
+	}
+	if r.TotalBytesSec < 0 || r.TotalIopsSec < 0 {
+		return errors.New("iotune limits can't be negative")
+	}
+	if r.VmName != "" && r.VmUuid != "" {
+		return errors.New("only one of vmName and vmUuid can be set")
+	}
+	if r.VmName != "" && !helperVmNameRegex.MatchString(r.VmName) {
+		return fmt.Errorf("invalid vm name %q", r.VmName)
+	}
+	if r.VmUuid != "" && !domainUuidRegex.MatchString(r.VmUuid) {
+		return fmt.Errorf("invalid vm uuid %q", r.VmUuid)
+	}
+	return nil
+}
+
+// setDomain Select the domain a NodeId refers to, by UUID if it is one
+func (r *HelperRequest) setDomain(nodeId string) {
+	if isDomainUuid(nodeId) {
+		r.VmUuid = strings.ToLower(nodeId)
+	} else {
+		r.VmName = nodeId
+	}
+}
+
+// commandLine sudo command line for the request. Every value is quoted even though Validate doesn't let through
+// anything that would need it
+func (r *HelperRequest) commandLine() string {
+	command := "sudo libvirt-storage-attach -operation=" + shellescape.Quote(r.Operation)
+	for _, flag := range []struct{ name, value string }{
+		{"backend", r.Backend},
+		{"pv-id", r.VolumeId},
+		{"volume-group", r.VolumeGroup},
+		{"thin-pool", r.ThinPool},
+		{"pool", r.Pool},
+		{"image-format", r.ImageFormat},
+		{"vm-name", r.VmName},
+		{"vm-uuid", r.VmUuid},
+		{"cache", r.CacheMode},
+		{"io", r.IoMode},
+		{"discard", r.Discard},
+		{"detect-zeroes", r.DetectZeroes},
+	} {
+		if flag.value != "" {
+			command += fmt.Sprintf(" -%s=%s", flag.name, shellescape.Quote(flag.value))
+		}
+	}
+	for _, flag := range []struct {
+		name  string
+		value int64
+	}{
+		{"size", r.Size},
+		{"total-bytes-sec", r.TotalBytesSec},
+		{"total-iops-sec", r.TotalIopsSec},
+	} {
+		if flag.value != 0 {
+			command += fmt.Sprintf(" -%s=%d", flag.name, flag.value)
+		}
+	}
+	if r.ReadOnly {
+		command += " -readonly"
+	}
+	if r.Shareable {
+		// libvirt-storage-attach marks the disk <shareable/> with cache=none
+		command += " -shareable"
+	}
+	return command
+}
+
+// helperClient Runs libvirt-storage-attach through one hypervisor account
+type helperClient struct {
+	runner RemoteSshRunner
+	mode   string
+}
+
+// run Validate the request and run it. Failures are logged with the helper's output
+func (h *helperClient) run(request *HelperRequest) (string, string, error) {
+	if err := request.Validate(); err != nil {
+		return "", "", fmt.Errorf("invalid libvirt-storage-attach request: %w", err)
+	}
+
+	var stdout, stderr string
+	var err error
+	switch h.mode {
+	case "", HelperModeSudo:
+		stdout, stderr, err = h.runner.RunCommand(request.commandLine(), nil)
+	case HelperModeForcedCommand:
+		input, jsonErr := json.Marshal(request)
+		if jsonErr != nil {
+			return "", "", jsonErr
+		}
+		stdout, stderr, err = h.runner.RunCommand(forcedCommand, input)
+	default:
+		return "", "", fmt.Errorf("unknown helper mode %q", h.mode)
+	}
+
+	if err != nil {
+		klog.InfoS("error running libvirt-storage-attach", "operation", request.Operation, "stdout", stdout, "stderr", stderr, "err", err.Error(), "pv-id", request.VolumeId)
+	}
+	return stdout, stderr, err
+}
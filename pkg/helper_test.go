@@ -0,0 +1,63 @@
+package pkg
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_HelperRequestValidate(t *testing.T) {
+	valid := []HelperRequest{
+		{Operation: helperOperationList},
+		{Operation: helperOperationCreate, Size: 1 << 30},
+		{Operation: helperOperationCreate, VolumeGroup: "vg_libvirt-01", Size: 1 << 30},
+		{Operation: helperOperationDelete, VolumeId: testVolumeId},
+		{Operation: helperOperationAttach, VolumeId: testVolumeId, VmName: "node-1", ReadOnly: true, Shareable: true},
+		{Operation: helperOperationDetach, VolumeId: testVolumeId, VmUuid: "0f3c2b1a-5d6e-4f70-8192-a3b4c5d6e7f8"},
+	}
+	for _, request := range valid {
+		assert.Nil(t, request.Validate(), request)
+	}
+
+	invalid := []HelperRequest{
+		{Operation: "list; reboot"},
+		{Operation: helperOperationCreate},
+		{Operation: helperOperationCreate, VolumeGroup: "vg; rm -rf /", Size: 1 << 30},
+		{Operation: helperOperationCreate, VolumeGroup: "--force", Size: 1 << 30},
+		{Operation: helperOperationDelete, VolumeId: "pv-../../etc"},
+		{Operation: helperOperationDelete, VolumeId: testVolumeId, VmName: "node-1"},
+		{Operation: helperOperationAttach, VolumeId: testVolumeId},
+		{Operation: helperOperationAttach, VolumeId: testVolumeId, VmName: "$(reboot)"},
+		{Operation: helperOperationDetach, VolumeId: testVolumeId, VmName: "node-1", ReadOnly: true},
+	}
+	for _, request := range invalid {
+		assert.NotNil(t, request.Validate(), request)
+	}
+}
+
+func Test_HelperRequestCommandLine(t *testing.T) {
+	request := &HelperRequest{Operation: helperOperationAttach, VolumeId: testVolumeId, ReadOnly: true}
+	request.setDomain("0F3C2B1A-5D6E-4F70-8192-A3B4C5D6E7F8")
+	assert.Equal(t, "sudo libvirt-storage-attach -operation=attach -pv-id="+testVolumeId+
+		" -vm-uuid=0f3c2b1a-5d6e-4f70-8192-a3b4c5d6e7f8 -readonly", request.commandLine())
+
+	request = &HelperRequest{Operation: helperOperationCreate, VolumeGroup: "vg0", Size: 1073741824}
+	assert.Equal(t, "sudo libvirt-storage-attach -operation=create -volume-group=vg0 -size=1073741824", request.commandLine())
+}
+
+func Test_HelperForcedCommand(t *testing.T) {
+	mockSsh := &mockSshRunner{}
+	helper := &helperClient{runner: mockSsh, mode: HelperModeForcedCommand}
+
+	_, _, err := helper.run(&HelperRequest{Operation: helperOperationDelete, VolumeId: testVolumeId})
+	assert.Nil(t, err)
+	assert.Equal(t, forcedCommand, mockSsh.Commands[0])
+	var sent HelperRequest
+	assert.Nil(t, json.Unmarshal(mockSsh.Stdins[0], &sent))
+	assert.Equal(t, HelperRequest{Operation: helperOperationDelete, VolumeId: testVolumeId}, sent)
+
+	// Invalid requests never reach the hypervisor
+	_, _, err = helper.run(&HelperRequest{Operation: helperOperationDelete, VolumeId: "pv-x; reboot"})
+	assert.NotNil(t, err)
+	assert.Len(t, mockSsh.Commands, 1)
+}
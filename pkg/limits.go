@@ -0,0 +1,151 @@
+package pkg
+
+import (
+	"fmt"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Used when the VM's controllers can't be detected
+const scsiControllerAvailable = 20
+
+// Buses libvirt-storage-attach can attach disks to. Only the one it uses counts towards the attach limit
+const attachBusScsi = "scsi"     // Units on the VM's virtio-scsi controllers (default)
+const attachBusVirtio = "virtio" // virtio-blk disks, one PCI hotplug slot each
+
+// Units libvirt assigns on a SCSI controller when it picks disk addresses itself, i.e. a wide SCSI bus, before
+// moving on to the next controller. QEMU's virtio-scsi takes far more, but only if the helper sets addresses
+const defaultDisksPerScsiController = 16
+
+// SCSI hosts, PCI hotplug slots and PCI devices in sysfs
+var sysScsiHostDir = "/sys/class/scsi_host"
+var sysPciSlotsDir = "/sys/bus/pci/slots"
+var sysPciDevicesDir = "/sys/bus/pci/devices"
+
+// Serials CreateVolume's volume ids turn into, possibly truncated by virtio-blk
+var volumeSerialRegex = regexp.MustCompile(`^[0-9a-f]{20,32}$`)
+
+// sysfs paths of virtio-blk disks end in .../virtioN/block/vdX
+var virtioBlkPathRegex = regexp.MustCompile(`/virtio\d+/block/[^/]+$`)
+
+// virtioScsiHosts Names (hostN) of the SCSI hosts backed by virtio-scsi controllers
+func virtioScsiHosts() []string {
+	entries, err := os.ReadDir(sysScsiHostDir)
+	if err != nil {
+		return nil
+	}
+
+	var hosts []string
+	for _, entry := range entries {
+		procName, err := os.ReadFile(filepath.Join(sysScsiHostDir, entry.Name(), "proc_name"))
+		if err == nil && strings.TrimSpace(string(procName)) == "virtio_scsi" {
+			hosts = append(hosts, entry.Name())
+		}
+	}
+	return hosts
+}
+
+// freePciHotplugSlots Hotplug slots without a device in them. Every virtio-blk disk takes one
+func freePciHotplugSlots() int {
+	entries, err := os.ReadDir(sysPciSlotsDir)
+	if err != nil {
+		return 0
+	}
+
+	free := 0
+	for _, entry := range entries {
+		address, err := os.ReadFile(filepath.Join(sysPciSlotsDir, entry.Name(), "address"))
+		if err != nil {
+			continue
+		}
+		functions, _ := filepath.Glob(filepath.Join(sysPciDevicesDir, strings.TrimSpace(string(address))+".*"))
+		if len(functions) == 0 {
+			free++
+		}
+	}
+	return free
+}
+
+// attachedDisks Count the whole disks on virtio-scsi hosts that aren't volumes, and the virtio-blk disks that are.
+// The former take units volumes could use, the latter take hotplug slots that aren't free anymore but belong to
+// volumes counted against the limit
+func attachedDisks(scsiHosts []string) (scsiSystemDisks int, virtioVolumeDisks int) {
+	entries, err := os.ReadDir(sysBlockDir)
+	if err != nil {
+		return 0, 0
+	}
+
+	for _, entry := range entries {
+		sysPath, err := filepath.EvalSymlinks(filepath.Join(sysBlockDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(sysPath, "partition")); err == nil {
+			continue
+		}
+		serial, _ := udevSerial(entry.Name())
+		isVolume := volumeSerialRegex.MatchString(serial)
+
+		if virtioBlkPathRegex.MatchString(sysPath) {
+			if isVolume {
+				virtioVolumeDisks++
+			}
+			continue
+		}
+		for _, host := range scsiHosts {
+			if strings.Contains(sysPath, "/"+host+"/") && !isVolume {
+				scsiSystemDisks++
+			}
+		}
+	}
+	return scsiSystemDisks, virtioVolumeDisks
+}
+
+// ParseAttachBus Validate the bus libvirt-storage-attach attaches disks to, scsi if it's empty
+func ParseAttachBus(value string) (string, error) {
+	switch value {
+	case "":
+		return attachBusScsi, nil
+	case attachBusScsi, attachBusVirtio:
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown attach bus %q, must be %s or %s", value, attachBusScsi, attachBusVirtio)
+}
+
+// maxVolumesPerNode How many volumes the VM can have attached on the bus libvirt-storage-attach uses, from its
+// virtio-scsi controllers or its free hotplug slots. Volumes attached right now are included since Kubernetes
+// counts them against the limit too
+func maxVolumesPerNode(bus string, disksPerScsiController int64) int64 {
+	if disksPerScsiController <= 0 {
+		disksPerScsiController = defaultDisksPerScsiController
+	}
+	scsiHosts := virtioScsiHosts()
+	scsiSystemDisks, virtioVolumeDisks := attachedDisks(scsiHosts)
+
+	var limit int64
+	var found bool
+	if bus == attachBusVirtio {
+		freeSlots := freePciHotplugSlots()
+		limit = int64(freeSlots + virtioVolumeDisks)
+		found = freeSlots > 0 || virtioVolumeDisks > 0
+		klog.InfoS("detected attach limit", "bus", bus, "freeHotplugSlots", freeSlots, "virtioVolumeDisks", virtioVolumeDisks, "limit", limit)
+	} else {
+		limit = int64(len(scsiHosts))*disksPerScsiController - int64(scsiSystemDisks)
+		found = len(scsiHosts) > 0
+		klog.InfoS("detected attach limit", "bus", bus, "virtioScsiControllers", len(scsiHosts), "disksPerController", disksPerScsiController,
+			"scsiSystemDisks", scsiSystemDisks, "limit", limit)
+	}
+
+	if !found {
+		klog.InfoS("no controllers found to attach volumes to, using default limit", "limit", scsiControllerAvailable)
+		return scsiControllerAvailable
+	}
+	// 0 would mean unlimited
+	if limit < 1 {
+		return 1
+	}
+	return limit
+}
@@ -0,0 +1,85 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeControllerTree Point the sysfs directories at a VM with a virtio-scsi controller holding the OS disk, a
+// virtio-blk volume and two hotplug slots of which one is free
+func fakeControllerTree(t *testing.T) {
+	root := fakeDeviceTree(t)
+	previousScsiHostDir, previousSlotsDir, previousPciDevicesDir := sysScsiHostDir, sysPciSlotsDir, sysPciDevicesDir
+	t.Cleanup(func() {
+		sysScsiHostDir, sysPciSlotsDir, sysPciDevicesDir = previousScsiHostDir, previousSlotsDir, previousPciDevicesDir
+	})
+	sysScsiHostDir = filepath.Join(root, "scsi_host")
+	sysPciSlotsDir = filepath.Join(root, "slots")
+	sysPciDevicesDir = filepath.Join(root, "pci")
+
+	write := func(path string, content string) {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	write(filepath.Join(sysScsiHostDir, "host0", "proc_name"), "virtio_scsi\n")
+	write(filepath.Join(sysScsiHostDir, "host1", "proc_name"), "ata_piix\n")
+	write(filepath.Join(sysPciSlotsDir, "0", "address"), "0000:01:00\n")
+	write(filepath.Join(sysPciSlotsDir, "1", "address"), "0000:02:00\n")
+	write(filepath.Join(sysPciDevicesDir, "0000:01:00.0", "vendor"), "0x1af4\n")
+
+	devices := filepath.Join(root, "devices")
+	disks := map[string]string{
+		"sda": filepath.Join(devices, "0000:00:04.0", "virtio2", "host0", "target0:0:0", "0:0:0:0", "block", "sda"),
+		"vda": filepath.Join(devices, "0000:01:00.0", "virtio3", "block", "vda"),
+	}
+	majorMinors := map[string]string{"sda": "8:0", "vda": "253:0"}
+	serials := map[string]string{"sda": "drive-scsi0", "vda": volumeSerial(testVolumeId)[:20]}
+	for name, path := range disks {
+		write(filepath.Join(path, "dev"), majorMinors[name]+"\n")
+		assert.Nil(t, os.Symlink(path, filepath.Join(sysBlockDir, name)))
+		write(filepath.Join(udevDataDir, "b"+majorMinors[name]), "E:DEVTYPE=disk\nE:ID_SERIAL_SHORT="+serials[name]+"\n")
+	}
+	write(filepath.Join(disks["sda"], "sda1", "partition"), "1\n")
+	assert.Nil(t, os.Symlink(filepath.Join(disks["sda"], "sda1"), filepath.Join(sysBlockDir, "sda1")))
+}
+
+func Test_MaxVolumesPerNode(t *testing.T) {
+	fakeControllerTree(t)
+
+	assert.Equal(t, []string{"host0"}, virtioScsiHosts())
+	assert.Equal(t, 1, freePciHotplugSlots())
+	scsiSystemDisks, virtioVolumeDisks := attachedDisks([]string{"host0"})
+	assert.Equal(t, 1, scsiSystemDisks)
+	assert.Equal(t, 1, virtioVolumeDisks)
+
+	// Only the bus the helper attaches to counts
+	assert.Equal(t, int64(defaultDisksPerScsiController-1), maxVolumesPerNode(attachBusScsi, 0))
+	assert.Equal(t, int64(32-1), maxVolumesPerNode(attachBusScsi, 32))
+	assert.Equal(t, int64(1+1), maxVolumesPerNode(attachBusVirtio, 0))
+}
+
+func Test_ParseAttachBus(t *testing.T) {
+	bus, err := ParseAttachBus("")
+	assert.Nil(t, err)
+	assert.Equal(t, attachBusScsi, bus)
+
+	bus, err = ParseAttachBus("virtio")
+	assert.Nil(t, err)
+	assert.Equal(t, attachBusVirtio, bus)
+
+	_, err = ParseAttachBus("ide")
+	assert.NotNil(t, err)
+}
+
+func Test_MaxVolumesPerNodeDefault(t *testing.T) {
+	fakeDeviceTree(t)
+	previousScsiHostDir, previousSlotsDir := sysScsiHostDir, sysPciSlotsDir
+	t.Cleanup(func() { sysScsiHostDir, sysPciSlotsDir = previousScsiHostDir, previousSlotsDir })
+	sysScsiHostDir = filepath.Join(t.TempDir(), "missing")
+	sysPciSlotsDir = sysScsiHostDir
+
+	assert.Equal(t, int64(scsiControllerAvailable), maxVolumesPerNode(attachBusScsi, 0))
+	assert.Equal(t, int64(scsiControllerAvailable), maxVolumesPerNode(attachBusVirtio, 0))
+}
@@ -0,0 +1,170 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var mountInfoPath = "/proc/self/mountinfo"
+
+// Upper bound on unmounting mounts stacked on the same target
+const maxStackedMounts = 8
+
+// mountInfo One line of /proc/self/mountinfo
+type mountInfo struct {
+	Root         string
+	MountPoint   string
+	MountOptions []string
+	FsType       string
+	Source       string
+	SuperOptions []string
+}
+
+// unescapeMountInfo Decode the octal escapes (\040 for space etc.) the kernel uses in mountinfo paths
+func unescapeMountInfo(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var builder strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) {
+			if code, err := strconv.ParseUint(value[i+1:i+4], 8, 8); err == nil {
+				builder.WriteByte(byte(code))
+				i += 3
+				continue
+			}
+		}
+		builder.WriteByte(value[i])
+	}
+	return builder.String()
+}
+
+// parseMountInfo Parse mountinfo lines, see proc(5)
+func parseMountInfo(reader io.Reader) ([]mountInfo, error) {
+	var mounts []mountInfo
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator < 0 || len(fields) < separator+4 {
+			return nil, fmt.Errorf("malformed mountinfo line %q", scanner.Text())
+		}
+
+		mounts = append(mounts, mountInfo{
+			Root:         unescapeMountInfo(fields[3]),
+			MountPoint:   unescapeMountInfo(fields[4]),
+			MountOptions: strings.Split(fields[5], ","),
+			FsType:       fields[separator+1],
+			Source:       unescapeMountInfo(fields[separator+2]),
+			SuperOptions: strings.Split(fields[separator+3], ","),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+func readMountInfo() ([]mountInfo, error) {
+	file, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseMountInfo(file)
+}
+
+// findMount The mount visible at path (the last one if several are stacked), nil if path isn't a mountpoint
+func findMount(path string) (*mountInfo, error) {
+	path = filepath.Clean(path)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	var found *mountInfo
+	for i := range mounts {
+		if mounts[i].MountPoint == path {
+			found = &mounts[i]
+		}
+	}
+	return found, nil
+}
+
+func isMountPoint(path string) (bool, error) {
+	mount, err := findMount(path)
+	return mount != nil, err
+}
+
+// isDeviceMounted Whether the device is the source of any mount, e.g. because the volume is already published at
+// another target on this node. Block volumes count too, their bind mounts show up as the device node on devtmpfs
+func isDeviceMounted(device string) (bool, error) {
+	device = filepath.Clean(device)
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		resolved = device
+	}
+
+	mounts, err := readMountInfo()
+	if err != nil {
+		return false, err
+	}
+	for _, mount := range mounts {
+		if mount.Source == device || mount.Source == resolved {
+			return true, nil
+		}
+		if source, err := filepath.EvalSymlinks(mount.Source); err == nil && source == resolved {
+			return true, nil
+		}
+		if mount.FsType == "devtmpfs" && mount.Root != "/" && filepath.Base(mount.Root) == filepath.Base(resolved) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// unmount Unmount path. A busy target is an error so the CO retries, the disk must not be detached while the
+// filesystem is still in use
+func unmount(ctx context.Context, path string) error {
+	out, err := execCommand(ctx, "umount", path).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(string(out), "busy") {
+		klog.ErrorS(err, "target busy", "path", path, "output", string(out))
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("%s is busy", path))
+	}
+	klog.ErrorS(err, "couldn't unmount", "path", path, "output", string(out))
+	return err
+}
+
+// unmountAll Unmount everything mounted at path. Doesn't fail if path isn't mounted or doesn't exist
+func unmountAll(ctx context.Context, path string) error {
+	for i := 0; i < maxStackedMounts; i++ {
+		mounted, err := isMountPoint(path)
+		if err != nil || !mounted {
+			return err
+		}
+		if err = unmount(ctx, path); err != nil {
+			return err
+		}
+	}
+	return errors.New("too many mounts stacked on " + path)
+}
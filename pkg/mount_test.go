@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testMountInfo = `22 1 253:1 / / rw,relatime shared:1 - ext4 /dev/vda1 rw
+98 22 8:17 / /var/lib/kubelet/pods/abc/volumes/kubernetes.io~csi/pv\040one/mount rw,relatime shared:45 - ext4 /dev/sdb1 rw
+99 22 0:5 /sdb /var/lib/kubelet/plugins/block/pv-two rw,relatime - devtmpfs udev rw,size=1000k
+100 98 8:17 / /var/lib/kubelet/pods/abc/volumes/kubernetes.io~csi/pv\040one/mount ro,relatime - ext4 /dev/sdb1 ro
+`
+
+func Test_ParseMountInfo(t *testing.T) {
+	mounts, err := parseMountInfo(strings.NewReader(testMountInfo))
+	assert.Nil(t, err)
+	assert.Len(t, mounts, 4)
+	assert.Equal(t, "/var/lib/kubelet/pods/abc/volumes/kubernetes.io~csi/pv one/mount", mounts[1].MountPoint)
+	assert.Equal(t, "ext4", mounts[1].FsType)
+	assert.Equal(t, "/dev/sdb1", mounts[1].Source)
+	assert.Equal(t, "/sdb", mounts[2].Root)
+	assert.Equal(t, []string{"rw", "size=1000k"}, mounts[2].SuperOptions)
+	assert.Equal(t, []string{"ro", "relatime"}, mounts[3].MountOptions)
+}
+
+func Test_ParseMountInfoMalformed(t *testing.T) {
+	_, err := parseMountInfo(strings.NewReader("22 1 253:1 / / rw,relatime shared:1 ext4 /dev/vda1 rw\n"))
+	assert.NotNil(t, err)
+}
+
+// fakeMountInfo Serve content as /proc/self/mountinfo
+func fakeMountInfo(t *testing.T, content string) {
+	path := filepath.Join(t.TempDir(), "mountinfo")
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+	original := mountInfoPath
+	mountInfoPath = path
+	t.Cleanup(func() { mountInfoPath = original })
+}
+
+func Test_FindMountStacked(t *testing.T) {
+	fakeMountInfo(t, testMountInfo)
+
+	mount, err := findMount("/var/lib/kubelet/pods/abc/volumes/kubernetes.io~csi/pv one/mount/")
+	assert.Nil(t, err)
+	assert.NotNil(t, mount)
+	assert.Equal(t, []string{"ro", "relatime"}, mount.MountOptions)
+
+	mounted, err := isMountPoint("/var/lib/kubelet/pods/abc")
+	assert.Nil(t, err)
+	assert.False(t, mounted)
+}
+
+func Test_IsDeviceMounted(t *testing.T) {
+	fakeMountInfo(t, testMountInfo)
+
+	mounted, err := isDeviceMounted("/dev/sdb1")
+	assert.Nil(t, err)
+	assert.True(t, mounted)
+
+	// Published as a block volume
+	mounted, err = isDeviceMounted("/dev/sdb")
+	assert.Nil(t, err)
+	assert.True(t, mounted)
+
+	mounted, err = isDeviceMounted("/dev/sdc1")
+	assert.Nil(t, err)
+	assert.False(t, mounted)
+}
+
+func Test_UnmountAllStacked(t *testing.T) {
+	target := t.TempDir()
+	mount := "98 22 8:17 / " + target + " rw,relatime - ext4 /dev/sdb1 rw\n"
+	fakeMountInfo(t, mount+mount)
+	commands := fakeCommands(t, func(name string, args []string) (string, int) {
+		// Each umount takes off the topmost mount
+		content, err := os.ReadFile(mountInfoPath)
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(mountInfoPath, content[len(mount):], 0644))
+		return "", 0
+	})
+
+	assert.Nil(t, unmountAll(context.Background(), target))
+	assert.Equal(t, []string{"umount " + target, "umount " + target}, *commands)
+
+	// Nothing left to unmount
+	assert.Nil(t, unmountAll(context.Background(), target))
+	assert.Len(t, *commands, 2)
+}
+
+func Test_UnmountAllBusy(t *testing.T) {
+	target := t.TempDir()
+	fakeMountInfo(t, "98 22 8:17 / "+target+" rw,relatime - ext4 /dev/sdb1 rw\n")
+	commands := fakeCommands(t, func(name string, args []string) (string, int) {
+		return "umount: " + target + ": target is busy.", 32
+	})
+
+	err := unmountAll(context.Background(), target)
+
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Equal(t, []string{"umount " + target}, *commands)
+}
@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Ways the node plugin can work out its NodeId, which the controller uses to find the libvirt domain
+const nodeIdSourceSmbios = "smbios"      // Domain UUID libvirt passes to the VM as the SMBIOS system UUID (default)
+const nodeIdSourceNodeName = "node-name" // Kubernetes node name, which has to match the domain name
+const nodeIdSourceMap = "map"            // Domain name or UUID looked up by node name in a JSON object
+
+// Where the kernel exposes the SMBIOS system UUID
+var dmiProductUuidPath = "/sys/class/dmi/id/product_uuid"
+
+var domainUuidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// isDomainUuid Whether a NodeId is a libvirt domain UUID rather than a domain name
+func isDomainUuid(nodeId string) bool {
+	return domainUuidRegex.MatchString(nodeId)
+}
+
+// smbiosUuid The VM's SMBIOS system UUID, lowercased like libvirt prints domain UUIDs
+func smbiosUuid() (string, error) {
+	content, err := os.ReadFile(dmiProductUuidPath)
+	if err != nil {
+		return "", err
+	}
+	uuid := strings.ToLower(strings.TrimSpace(string(content)))
+	if !isDomainUuid(uuid) {
+		return "", fmt.Errorf("%s doesn't hold a UUID: %q", dmiProductUuidPath, uuid)
+	}
+	return uuid, nil
+}
+
+// mappedNodeId Look up the node in a JSON object mapping node names to domain names or UUIDs
+func mappedNodeId(mapFile string, nodeName string) (string, error) {
+	content, err := os.ReadFile(mapFile)
+	if err != nil {
+		return "", err
+	}
+	var nodeIds map[string]string
+	if err := json.Unmarshal(content, &nodeIds); err != nil {
+		return "", fmt.Errorf("invalid node id map %s: %w", mapFile, err)
+	}
+	nodeId, ok := nodeIds[nodeName]
+	if !ok || nodeId == "" {
+		return "", fmt.Errorf("node %s isn't in node id map %s", nodeName, mapFile)
+	}
+	return nodeId, nil
+}
+
+// nodeId NodeId to report for this node, see NodeIdSource
+func (s *LibvirtCsiDriver) nodeId() (string, error) {
+	var nodeId string
+	var err error
+	switch s.NodeIdSource {
+	case "", nodeIdSourceSmbios:
+		nodeId, err = smbiosUuid()
+	case nodeIdSourceNodeName:
+		nodeId = s.NodeName
+	case nodeIdSourceMap:
+		nodeId, err = mappedNodeId(s.NodeIdMapFile, s.NodeName)
+	default:
+		err = fmt.Errorf("unknown node id source %q", s.NodeIdSource)
+	}
+	if err != nil {
+		return "", status.Error(codes.Internal, fmt.Sprintf("couldn't determine node id: %s", err))
+	}
+	if nodeId == "" {
+		return "", status.Error(codes.Internal, "couldn't determine node id: node name isn't set")
+	}
+	return nodeId, nil
+}
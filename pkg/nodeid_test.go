@@ -0,0 +1,36 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_NodeIdSmbios(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "product_uuid")
+	assert.Nil(t, os.WriteFile(path, []byte("0F3C2B1A-5D6E-4F70-8192-A3B4C5D6E7F8\n"), 0400))
+	previous := dmiProductUuidPath
+	dmiProductUuidPath = path
+	t.Cleanup(func() { dmiProductUuidPath = previous })
+
+	nodeId, err := (&LibvirtCsiDriver{NodeName: "node-1"}).nodeId()
+	assert.Nil(t, err)
+	assert.Equal(t, "0f3c2b1a-5d6e-4f70-8192-a3b4c5d6e7f8", nodeId)
+
+	nodeId, err = (&LibvirtCsiDriver{NodeIdSource: nodeIdSourceNodeName, NodeName: "node-1"}).nodeId()
+	assert.Nil(t, err)
+	assert.Equal(t, "node-1", nodeId)
+}
+
+func Test_NodeIdMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`{"node-1":"k8s-worker-01"}`), 0644))
+
+	nodeId, err := (&LibvirtCsiDriver{NodeIdSource: nodeIdSourceMap, NodeName: "node-1", NodeIdMapFile: path}).nodeId()
+	assert.Nil(t, err)
+	assert.Equal(t, "k8s-worker-01", nodeId)
+
+	_, err = (&LibvirtCsiDriver{NodeIdSource: nodeIdSourceMap, NodeName: "node-2", NodeIdMapFile: path}).nodeId()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,238 @@
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StorageClass parameters CreateVolume understands besides the filesystem ones in filesystem.go
+const parameterVolumeGroup = "volumeGroup"
+const parameterFsType = "fsType"                           // Filesystem if the volume capability doesn't name one
+const parameterSizeGranularity = "sizeGranularity"         // Volume sizes are rounded up to a multiple of this
+const parameterThinPool = "thinPool"                       // Create thin LVs in this pool of the volume group
+const parameterOvercommitRatio = "overcommitRatio"         // Thin volumes may add up to this times the pool size
+const parameterThinPoolFullPercent = "thinPoolFullPercent" // Refuse new thin volumes from this pool usage on
+const parameterBackend = "backend"                         // One of the backend constants, lvm if not set
+const parameterPool = "pool"                               // Directory, parent dataset or Ceph pool of the other backends
+const parameterImageFormat = "imageFormat"                 // Image format of the dir backend
+
+// LVM's default extent size
+const defaultSizeGranularity = 4 * 1024 * 1024
+
+// Coarser rounding wastes more than most volumes are worth
+const maxSizeGranularity = 64 * 1024 * 1024 * 1024
+
+const defaultOvercommitRatio = 1.0
+const defaultThinPoolFullPercent = 90.0
+
+// Keys the external-provisioner handles itself and may pass along
+const reservedParameterPrefix = "csi.storage.k8s.io/"
+
+// Every parameter CreateVolume accepts. Anything else is rejected so typos don't go unnoticed
+var knownParameters = map[string]struct{}{
+	parameterVolumeGroup:         {},
+	parameterMultiAttach:         {},
+	parameterPartitioned:         {},
+	parameterEncrypted:           {},
+	parameterFsType:              {},
+	parameterSizeGranularity:     {},
+	parameterThinPool:            {},
+	parameterOvercommitRatio:     {},
+	parameterThinPoolFullPercent: {},
+	parameterBackend:             {},
+	parameterPool:                {},
+	parameterImageFormat:         {},
+	parameterCacheMode:           {},
+	parameterIoMode:              {},
+	parameterDiscard:             {},
+	parameterDetectZeroes:        {},
+	parameterTotalBytesSec:       {},
+	parameterTotalIopsSec:        {},
+	parameterMkfsBlockSize:       {},
+	parameterMkfsInodeRatio:      {},
+	parameterMkfsReflink:         {},
+	parameterMkfsLabel:           {},
+	parameterMountOptions:        {},
+	parameterFsck:                {},
+}
+
+var binarySizeRegex = regexp.MustCompile(`^([0-9]+)(Ki|Mi|Gi|Ti)?$`)
+
+var binarySizeUnits = map[string]int64{
+	"":   1,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+}
+
+// volumeParameters Validated StorageClass parameters, except the filesystem ones
+type volumeParameters struct {
+	Backend         string
+	Pool            string // Empty for lvm
+	ImageFormat     string // dir only, empty for the helper's default
+	VolumeGroup     string // Empty for the helper's default
+	MultiAttach     bool
+	Partitioned     bool // New volumes put the filesystem on the whole disk unless asked otherwise
+	Encrypted       bool
+	FsType          string
+	SizeGranularity int64
+
+	ThinPool            string // Empty for thick volumes
+	OvercommitRatio     float64
+	ThinPoolFullPercent float64
+
+	Tuning diskTuning
+}
+
+// parseBinarySize Parse a size in bytes, optionally with a binary suffix like 4Mi
+func parseBinarySize(value string) (int64, error) {
+	match := binarySizeRegex.FindStringSubmatch(value)
+	if match == nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	number, err := strconv.ParseInt(match[1], 10, 64)
+	unit := binarySizeUnits[match[2]]
+	if err != nil || number > (1<<62)/unit {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return number * unit, nil
+}
+
+func parseBoolParameter(parameters map[string]string, key string) (bool, error) {
+	value, ok := parameters[key]
+	if !ok {
+		return false, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s parameter %q", key, value)
+	}
+	return parsed, nil
+}
+
+// parseVolumeParameters Check every parameter is known and parse the ones that aren't filesystem options
+func parseVolumeParameters(parameters map[string]string) (*volumeParameters, error) {
+	var unknown []string
+	for key := range parameters {
+		if _, ok := knownParameters[key]; !ok && !strings.HasPrefix(key, reservedParameterPrefix) {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown parameters %s", strings.Join(unknown, ", "))
+	}
+
+	result := &volumeParameters{
+		Backend:         backendLvm,
+		Pool:            parameters[parameterPool],
+		ImageFormat:     parameters[parameterImageFormat],
+		VolumeGroup:     parameters[parameterVolumeGroup],
+		FsType:          parameters[parameterFsType],
+		SizeGranularity: defaultSizeGranularity,
+
+		ThinPool:            parameters[parameterThinPool],
+		OvercommitRatio:     defaultOvercommitRatio,
+		ThinPoolFullPercent: defaultThinPoolFullPercent,
+	}
+	if result.VolumeGroup != "" && !helperVolumeGroupRegex.MatchString(result.VolumeGroup) {
+		return nil, fmt.Errorf("invalid %s parameter %q", parameterVolumeGroup, result.VolumeGroup)
+	}
+	if result.FsType != "" {
+		if err := validateFilesystem(result.FsType); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if result.MultiAttach, err = parseBoolParameter(parameters, parameterMultiAttach); err != nil {
+		return nil, err
+	}
+	if result.Partitioned, err = parseBoolParameter(parameters, parameterPartitioned); err != nil {
+		return nil, err
+	}
+	if result.Encrypted, err = parseBoolParameter(parameters, parameterEncrypted); err != nil {
+		return nil, err
+	}
+	// Every node would try to open (or format) the LUKS header on its own
+	if result.Encrypted && result.MultiAttach {
+		return nil, fmt.Errorf("%s volumes can't be %s", parameterMultiAttach, parameterEncrypted)
+	}
+
+	tuning, err := parseDiskTuning(parameters, result.MultiAttach)
+	if err != nil {
+		return nil, err
+	}
+	result.Tuning = *tuning
+
+	if value, ok := parameters[parameterSizeGranularity]; ok {
+		granularity, err := parseBinarySize(value)
+		if err != nil || granularity < 1<<20 || granularity > maxSizeGranularity || granularity&(granularity-1) != 0 {
+			return nil, fmt.Errorf("%s must be a power of 2 between 1Mi and 64Gi, got %q", parameterSizeGranularity, value)
+		}
+		result.SizeGranularity = granularity
+	}
+
+	if result.ThinPool != "" && !helperVolumeGroupRegex.MatchString(result.ThinPool) {
+		return nil, fmt.Errorf("invalid %s parameter %q", parameterThinPool, result.ThinPool)
+	}
+	for key, target := range map[string]*float64{
+		parameterOvercommitRatio:     &result.OvercommitRatio,
+		parameterThinPoolFullPercent: &result.ThinPoolFullPercent,
+	} {
+		value, ok := parameters[key]
+		if !ok {
+			continue
+		}
+		if result.ThinPool == "" {
+			return nil, fmt.Errorf("%s requires %s", key, parameterThinPool)
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed <= 0 || (key == parameterThinPoolFullPercent && parsed > 100) {
+			return nil, fmt.Errorf("invalid %s parameter %q", key, value)
+		}
+		*target = parsed
+	}
+
+	if value, ok := parameters[parameterBackend]; ok {
+		result.Backend = value
+	}
+	backend, ok := storageBackends[result.Backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown %s %q", parameterBackend, result.Backend)
+	}
+	if err := backend.validateParameters(result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// volumeContext Parameters in the form the node reads them
+func (p *volumeParameters) volumeContext() map[string]string {
+	volumeContext := map[string]string{
+		parameterVolumeGroup:     p.VolumeGroup,
+		parameterMultiAttach:     strconv.FormatBool(p.MultiAttach),
+		parameterPartitioned:     strconv.FormatBool(p.Partitioned),
+		parameterEncrypted:       strconv.FormatBool(p.Encrypted),
+		parameterSizeGranularity: strconv.FormatInt(p.SizeGranularity, 10),
+	}
+	if p.FsType != "" {
+		volumeContext[parameterFsType] = p.FsType
+	}
+	if p.ThinPool != "" {
+		volumeContext[parameterThinPool] = p.ThinPool
+	}
+	for key, value := range p.Tuning.volumeContext() {
+		volumeContext[key] = value
+	}
+	if p.Backend != backendLvm {
+		volumeContext[parameterBackend] = p.Backend
+		volumeContext[parameterPool] = p.Pool
+	}
+	return volumeContext
+}
@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func Test_ParseVolumeParameters(t *testing.T) {
+	parameters, err := parseVolumeParameters(map[string]string{
+		parameterVolumeGroup:          "vg_libvirt",
+		parameterMultiAttach:          "1",
+		parameterFsType:               "xfs",
+		parameterSizeGranularity:      "8Mi",
+		parameterMkfsReflink:          "true",
+		"csi.storage.k8s.io/pvc/name": "data",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, &volumeParameters{Backend: backendLvm, VolumeGroup: "vg_libvirt", MultiAttach: true, FsType: "xfs", SizeGranularity: 8 << 20,
+		OvercommitRatio: defaultOvercommitRatio, ThinPoolFullPercent: defaultThinPoolFullPercent, Tuning: diskTuning{Discard: defaultDiscard}}, parameters)
+	assert.Equal(t, map[string]string{
+		parameterVolumeGroup:     "vg_libvirt",
+		parameterMultiAttach:     "true",
+		parameterPartitioned:     "false",
+		parameterEncrypted:       "false",
+		parameterFsType:          "xfs",
+		parameterSizeGranularity: "8388608",
+	}, parameters.volumeContext())
+}
+
+func Test_ParseVolumeParametersDefaults(t *testing.T) {
+	parameters, err := parseVolumeParameters(nil)
+
+	assert.Nil(t, err)
+	assert.Equal(t, &volumeParameters{Backend: backendLvm, SizeGranularity: defaultSizeGranularity, OvercommitRatio: 1, ThinPoolFullPercent: 90,
+		Tuning: diskTuning{Discard: defaultDiscard}}, parameters)
+}
+
+func Test_ParseVolumeParametersThinPool(t *testing.T) {
+	parameters, err := parseVolumeParameters(map[string]string{
+		parameterThinPool:            "thinpool",
+		parameterOvercommitRatio:     "2.5",
+		parameterThinPoolFullPercent: "80",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "thinpool", parameters.ThinPool)
+	assert.Equal(t, 2.5, parameters.OvercommitRatio)
+	assert.Equal(t, 80.0, parameters.ThinPoolFullPercent)
+	assert.Equal(t, "thinpool", parameters.volumeContext()[parameterThinPool])
+}
+
+func Test_ParseVolumeParametersInvalid(t *testing.T) {
+	for _, parameters := range []map[string]string{
+		{"type": "libvirt"},
+		{parameterVolumeGroup: "vg0 -f"},
+		{parameterVolumeGroup: "-vg0"},
+		{parameterFsType: "ntfs"},
+		{parameterMultiAttach: "yes please"},
+		{parameterEncrypted: "true", parameterMultiAttach: "true"},
+		{parameterSizeGranularity: "512Ki"},
+		{parameterSizeGranularity: "3Mi"},
+		{parameterSizeGranularity: "4MB"},
+		{parameterSizeGranularity: "128Gi"},
+		{parameterThinPool: "pool;"},
+		{parameterOvercommitRatio: "2"},
+		{parameterThinPool: "thinpool", parameterOvercommitRatio: "0"},
+		{parameterThinPool: "thinpool", parameterOvercommitRatio: "lots"},
+		{parameterThinPool: "thinpool", parameterThinPoolFullPercent: "101"},
+	} {
+		_, err := parseVolumeParameters(parameters)
+		assert.NotNil(t, err, parameters)
+	}
+}
+
+func Test_ParseBinarySize(t *testing.T) {
+	size, err := parseBinarySize("4Mi")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4<<20), size)
+
+	size, err = parseBinarySize("1048576")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1<<20), size)
+
+	_, err = parseBinarySize("99999999999999Ti")
+	assert.NotNil(t, err)
+}
+
+func Test_CreateVolumeUnknownParameter(t *testing.T) {
+	mockSsh, controller := newController()
+
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		Parameters:         map[string]string{"type": "libvirt"},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Empty(t, mockSsh.Commands)
+}
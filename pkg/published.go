@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"errors"
+	"k8s.io/klog/v2"
+	"os"
+)
+
+// publishedVolumes Filesystem volumes published read-write on this node by target path, the ones fstrim runs on.
+// Loaded from PublishedVolumesFile on first use so volumes published before a restart are still trimmed
+func (s *LibvirtCsiDriver) publishedVolumes() map[string]string {
+	s.publishedLock.Lock()
+	defer s.publishedLock.Unlock()
+
+	s.loadPublishedVolumes()
+	volumes := make(map[string]string, len(s.published))
+	for target, volumeId := range s.published {
+		volumes[target] = volumeId
+	}
+	return volumes
+}
+
+// addPublishedVolume Remember a volume mounted read-write at target
+func (s *LibvirtCsiDriver) addPublishedVolume(volumeId string, target string) {
+	s.publishedLock.Lock()
+	defer s.publishedLock.Unlock()
+
+	s.loadPublishedVolumes()
+	if s.published[target] == volumeId {
+		return
+	}
+	s.published[target] = volumeId
+	s.savePublishedVolumes()
+}
+
+// removePublishedVolume Forget the volume published at target, if any
+func (s *LibvirtCsiDriver) removePublishedVolume(target string) {
+	s.publishedLock.Lock()
+	defer s.publishedLock.Unlock()
+
+	s.loadPublishedVolumes()
+	if _, ok := s.published[target]; !ok {
+		return
+	}
+	volumeId := s.published[target]
+	delete(s.published, target)
+	s.savePublishedVolumes()
+
+	for _, published := range s.published {
+		if published == volumeId {
+			return
+		}
+	}
+	trimmedBytesByVolume.Delete(volumeId)
+}
+
+// loadPublishedVolumes Read the registry file once. Must be called with publishedLock held
+func (s *LibvirtCsiDriver) loadPublishedVolumes() {
+	if s.published != nil {
+		return
+	}
+	s.published = make(map[string]string)
+	if s.PublishedVolumesFile == "" {
+		return
+	}
+
+	err := readJsonFile(s.PublishedVolumesFile, &s.published)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		klog.ErrorS(err, "couldn't read published volumes, starting with none", "file", s.PublishedVolumesFile)
+		s.published = make(map[string]string)
+	}
+}
+
+// savePublishedVolumes Replace the registry file. Must be called with publishedLock held. Failures are only
+// logged, the registry just helps fstrim after a restart
+func (s *LibvirtCsiDriver) savePublishedVolumes() {
+	if s.PublishedVolumesFile == "" {
+		return
+	}
+
+	if err := writeJsonFile(s.PublishedVolumesFile, s.published); err != nil {
+		klog.ErrorS(err, "couldn't write published volumes", "file", s.PublishedVolumesFile)
+	}
+}
@@ -0,0 +1,214 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// The kernel log, read one record at a time
+var kernelLogPath = "/dev/kmsg"
+
+// Kernel messages reporting an I/O or filesystem error, the first group is the device name
+var kernelErrorRegexes = []*regexp.Regexp{
+	regexp.MustCompile(`I/O error,? (?:on )?dev ([\w-]+)`),
+	regexp.MustCompile(`(?:EXT4-fs|BTRFS) error \(device ([\w-]+)\)`),
+	regexp.MustCompile(`XFS \(([\w-]+)\): .*(?:I/O error|[Cc]orruption)`),
+}
+
+// filesystemUsage Byte and inode usage of the filesystem mounted at path
+func filesystemUsage(path string) ([]*csi.VolumeUsage, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return nil, err
+	}
+
+	blockSize := stat.Bsize
+	return []*csi.VolumeUsage{{
+		Unit:      csi.VolumeUsage_BYTES,
+		Available: int64(stat.Bavail) * blockSize,
+		Total:     int64(stat.Blocks) * blockSize,
+		Used:      int64(stat.Blocks-stat.Bfree) * blockSize,
+	}, {
+		Unit:      csi.VolumeUsage_INODES,
+		Available: int64(stat.Ffree),
+		Total:     int64(stat.Files),
+		Used:      int64(stat.Files - stat.Ffree),
+	}}, nil
+}
+
+// blockDeviceSize Size in bytes of the block device at path (which can be a bind mount of one)
+func blockDeviceSize(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var size uint64
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, file.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, errno
+	}
+	return int64(size), nil
+}
+
+// mountedDevice The device behind a mount. Block volumes are bind mounts out of devtmpfs, where the root is the
+// device's path in /dev
+func mountedDevice(mount *mountInfo) string {
+	if mount.FsType == "devtmpfs" {
+		return "/dev" + strings.TrimSuffix(mount.Root, "//deleted")
+	}
+	return mount.Source
+}
+
+// relatedBlockDevices Kernel names the kernel log may use for errors on device: the device itself, the disk a
+// partition is on and the devices a device mapper device sits on
+func relatedBlockDevices(device string) []string {
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		device = resolved
+	}
+	names := []string{filepath.Base(device)}
+	for i := 0; i < len(names); i++ {
+		sysPath, err := filepath.EvalSymlinks(filepath.Join(sysBlockDir, names[i]))
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(sysPath, "partition")); err == nil {
+			names = append(names, filepath.Base(filepath.Dir(sysPath)))
+		}
+		slaves, _ := os.ReadDir(filepath.Join(sysPath, "slaves"))
+		for _, slave := range slaves {
+			if !slices.Contains(names, slave.Name()) {
+				names = append(names, slave.Name())
+			}
+		}
+	}
+	return names
+}
+
+// parseKernelLogRecord Sequence number and message of a /dev/kmsg record, "priority,sequence,timestamp,flags;message"
+func parseKernelLogRecord(record string) (uint64, string, bool) {
+	prefix, message, found := strings.Cut(record, ";")
+	if !found {
+		return 0, "", false
+	}
+	fields := strings.Split(prefix, ",")
+	if len(fields) < 3 {
+		return 0, "", false
+	}
+	sequence, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	// Continuation lines (key=value metadata) follow the message
+	message, _, _ = strings.Cut(message, "\n")
+	return sequence, message, true
+}
+
+// kernelErrorDevice The device a kernel message reports an error for, empty if it isn't an error
+func kernelErrorDevice(message string) string {
+	for _, re := range kernelErrorRegexes {
+		if match := re.FindStringSubmatch(message); match != nil {
+			return match[1]
+		}
+	}
+	return ""
+}
+
+// scanKernelLog Read kernel messages logged since the last scan and remember the latest error for each device.
+// Every read of /dev/kmsg returns one record and the non-blocking read fails with EAGAIN once all were read. The
+// first scan only finds where the log ends, errors from before a plugin restart may be for device names since reused
+// by other volumes
+func (s *LibvirtCsiDriver) scanKernelLog() error {
+	// Plain syscalls, an os.File would park in the poller instead of returning EAGAIN
+	fd, err := unix.Open(kernelLogPath, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	s.kernelLogLock.Lock()
+	defer s.kernelLogLock.Unlock()
+	if s.deviceErrors == nil {
+		s.deviceErrors = make(map[string]string)
+	}
+
+	buffer := make([]byte, 8192)
+	for {
+		n, err := unix.Read(fd, buffer)
+		if errors.Is(err, unix.EPIPE) {
+			// Records were overwritten while reading, carry on with the oldest one left
+			continue
+		}
+		if err != nil || n <= 0 {
+			break
+		}
+
+		sequence, message, ok := parseKernelLogRecord(string(buffer[:n]))
+		if !ok || (s.kernelLogScanned && sequence <= s.kernelLogSequence) {
+			continue
+		}
+		s.kernelLogSequence = sequence
+		if !s.kernelLogScanned {
+			continue
+		}
+		if device := kernelErrorDevice(message); device != "" {
+			s.deviceErrors[device] = message
+		}
+	}
+	s.kernelLogScanned = true
+	return nil
+}
+
+// deviceError Latest kernel error reported for any of the devices
+func (s *LibvirtCsiDriver) deviceError(devices []string) string {
+	s.kernelLogLock.Lock()
+	defer s.kernelLogLock.Unlock()
+	for _, device := range devices {
+		if message, ok := s.deviceErrors[device]; ok {
+			return message
+		}
+	}
+	return ""
+}
+
+// clearDeviceErrors Forget errors logged for devices, e.g. when a device name is reused for another volume
+func (s *LibvirtCsiDriver) clearDeviceErrors(devices []string) {
+	s.kernelLogLock.Lock()
+	defer s.kernelLogLock.Unlock()
+	for _, device := range devices {
+		delete(s.deviceErrors, device)
+	}
+}
+
+// checkMountHealth Problems with a published volume visible from the node, nil if there are none
+func (s *LibvirtCsiDriver) checkMountHealth(volumeId string, mount *mountInfo) *csi.VolumeCondition {
+	device := mountedDevice(mount)
+	if _, err := os.Stat(device); err != nil || strings.HasSuffix(mount.Root, "//deleted") {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("device %s of volume %s is gone", device, volumeId)}
+	}
+
+	// A filesystem published read-write with a read-only superblock was remounted read-only by the kernel after
+	// an error
+	if slices.Contains(mount.SuperOptions, "ro") && slices.Contains(mount.MountOptions, "rw") {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("filesystem of volume %s was remounted read-only", volumeId)}
+	}
+
+	if err := s.scanKernelLog(); err != nil {
+		klog.ErrorS(err, "couldn't read kernel log", "pv", volumeId)
+	}
+	if message := s.deviceError(relatedBlockDevices(device)); message != "" {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("kernel reported an error for volume %s: %s", volumeId, message)}
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_ParseKernelLogRecord(t *testing.T) {
+	sequence, message, ok := parseKernelLogRecord("3,1234,5140900,-;blk_update_request: I/O error, dev sdb, sector 2048 op 0x1:(WRITE)\n SUBSYSTEM=block\n DEVICE=b8:16\n")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1234), sequence)
+	assert.Equal(t, "blk_update_request: I/O error, dev sdb, sector 2048 op 0x1:(WRITE)", message)
+
+	_, _, ok = parseKernelLogRecord("no prefix")
+	assert.False(t, ok)
+}
+
+func Test_KernelErrorDevice(t *testing.T) {
+	assert.Equal(t, "sdb", kernelErrorDevice("blk_update_request: I/O error, dev sdb, sector 2048"))
+	assert.Equal(t, "vdc", kernelErrorDevice("I/O error, dev vdc, sector 0 op 0x0:(READ) flags 0x0 phys_seg 1 prio class 2"))
+	assert.Equal(t, "sdb1", kernelErrorDevice("Buffer I/O error on dev sdb1, logical block 0, lost async page write"))
+	assert.Equal(t, "dm-0", kernelErrorDevice("EXT4-fs error (device dm-0): ext4_find_entry:1455: inode #2: comm ls: reading directory lblock 0"))
+	assert.Equal(t, "sdc1", kernelErrorDevice("XFS (sdc1): metadata I/O error in \"xfs_imap_to_bp+0x5c/0xa0\" at daddr 0x20 len 32 error 5"))
+	assert.Equal(t, "", kernelErrorDevice("EXT4-fs (sdb1): mounted filesystem with ordered data mode"))
+}
+
+func Test_MountedDevice(t *testing.T) {
+	assert.Equal(t, "/dev/sdb1", mountedDevice(&mountInfo{Root: "/", FsType: "ext4", Source: "/dev/sdb1"}))
+	assert.Equal(t, "/dev/sdb", mountedDevice(&mountInfo{Root: "/sdb", FsType: "devtmpfs", Source: "udev"}))
+	assert.Equal(t, "/dev/sdb", mountedDevice(&mountInfo{Root: "/sdb//deleted", FsType: "devtmpfs", Source: "udev"}))
+}
+
+func Test_RelatedBlockDevices(t *testing.T) {
+	root := fakeDeviceTree(t)
+	devices := filepath.Join(root, "devices")
+	assert.Nil(t, os.MkdirAll(filepath.Join(devices, "sdb", "sdb1"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(devices, "sdb", "sdb1", "partition"), []byte("1\n"), 0644))
+	assert.Nil(t, os.MkdirAll(filepath.Join(devices, "dm-0", "slaves", "sdb1"), 0755))
+	for _, name := range []string{"sdb", "dm-0"} {
+		assert.Nil(t, os.Symlink(filepath.Join(devices, name), filepath.Join(sysBlockDir, name)))
+	}
+	assert.Nil(t, os.Symlink(filepath.Join(devices, "sdb", "sdb1"), filepath.Join(sysBlockDir, "sdb1")))
+
+	assert.Equal(t, []string{"sdb"}, relatedBlockDevices("/dev/sdb"))
+	assert.Equal(t, []string{"sdb1", "sdb"}, relatedBlockDevices("/dev/sdb1"))
+	assert.Equal(t, []string{"dm-0", "sdb1", "sdb"}, relatedBlockDevices("/dev/dm-0"))
+}
+
+func Test_DeviceErrors(t *testing.T) {
+	s := &LibvirtCsiDriver{deviceErrors: map[string]string{"sdb": "I/O error, dev sdb, sector 0"}}
+	assert.Equal(t, "I/O error, dev sdb, sector 0", s.deviceError([]string{"sdb1", "sdb"}))
+	s.clearDeviceErrors([]string{"sdb1", "sdb"})
+	assert.Equal(t, "", s.deviceError([]string{"sdb1", "sdb"}))
+}
+
+func Test_ScanKernelLog(t *testing.T) {
+	previous := kernelLogPath
+	kernelLogPath = filepath.Join(t.TempDir(), "kmsg")
+	t.Cleanup(func() { kernelLogPath = previous })
+	s := &LibvirtCsiDriver{}
+
+	// Logged before the plugin started, possibly for a volume that had sdb before
+	assert.Nil(t, os.WriteFile(kernelLogPath, []byte("3,5,100,-;I/O error, dev sdb, sector 0 op 0x1:(WRITE)"), 0644))
+	assert.Nil(t, s.scanKernelLog())
+	assert.Equal(t, "", s.deviceError([]string{"sdb"}))
+
+	assert.Nil(t, os.WriteFile(kernelLogPath, []byte("3,6,200,-;I/O error, dev sdb, sector 8 op 0x1:(WRITE)"), 0644))
+	assert.Nil(t, s.scanKernelLog())
+	assert.Equal(t, "I/O error, dev sdb, sector 8 op 0x1:(WRITE)", s.deviceError([]string{"sdb"}))
+}
@@ -0,0 +1,98 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"k8s.io/klog/v2"
+	"math"
+)
+
+// poolCapacity What libvirt-storage-attach -operation=capacity reports for a volume group, a thin pool in it with
+// -thin-pool, or the pool of another backend
+type poolCapacity struct {
+	Size int64 // Volume group or pool size, or thin pool data size
+	Free int64 // Unallocated bytes in the volume group or pool, or unused bytes in the thin pool
+
+	// Thin pools only
+	DataPercent     float64
+	MetadataPercent float64
+	VirtualSize     int64 // Sum of the sizes of the thin volumes in the pool
+}
+
+// getPoolCapacity Run a capacity request and parse what the helper reports
+func getPoolCapacity(helper *helperClient, request *HelperRequest) (*poolCapacity, error) {
+	stdout, _, err := helper.run(request)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf("couldn't get pool capacity: %s", err))
+	}
+	var capacity poolCapacity
+	if err := json.Unmarshal([]byte(stdout), &capacity); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("invalid pool capacity %q: %s", stdout, err))
+	}
+	return &capacity, nil
+}
+
+// nearFull Whether data or metadata usage of a thin pool reached the threshold
+func (c *poolCapacity) nearFull(parameters *volumeParameters) bool {
+	return c.DataPercent >= parameters.ThinPoolFullPercent || c.MetadataPercent >= parameters.ThinPoolFullPercent
+}
+
+// overcommitLimit Total size the thin volumes in a pool may add up to
+func (c *poolCapacity) overcommitLimit(parameters *volumeParameters) int64 {
+	limit := float64(c.Size) * parameters.OvercommitRatio
+	if limit >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(limit)
+}
+
+// available Bytes new volumes can still be created with. Thin pools count virtual sizes against the overcommit
+// limit and have nothing available once they're near full
+func (c *poolCapacity) available(parameters *volumeParameters) int64 {
+	if parameters.ThinPool == "" {
+		return c.Free
+	}
+	if c.nearFull(parameters) {
+		return 0
+	}
+	return max(c.overcommitLimit(parameters)-c.VirtualSize, 0)
+}
+
+// checkThinPoolSpace ResourceExhausted if a thin volume of the given size would exceed the overcommit limit or
+// the pool is near full
+func checkThinPoolSpace(capacity *poolCapacity, parameters *volumeParameters, size int64) error {
+	if capacity.nearFull(parameters) {
+		return status.Error(codes.ResourceExhausted, fmt.Sprintf("thin pool %s is near full: data %.1f%%, metadata %.1f%%, limit %.1f%%",
+			parameters.ThinPool, capacity.DataPercent, capacity.MetadataPercent, parameters.ThinPoolFullPercent))
+	}
+	if limit := capacity.overcommitLimit(parameters); size > limit-capacity.VirtualSize {
+		return status.Error(codes.ResourceExhausted, fmt.Sprintf("thin pool %s would be overcommitted: %d bytes requested, %d of %d bytes (%gx the pool size) already provisioned",
+			parameters.ThinPool, size, capacity.VirtualSize, limit, parameters.OvercommitRatio))
+	}
+	return nil
+}
+
+// logPoolCapacity Log pool usage, the only place thin pool metadata usage shows up
+func logPoolCapacity(parameters *volumeParameters, capacity *poolCapacity) {
+	if parameters.ThinPool == "" {
+		klog.InfoS("pool capacity", "backend", parameters.Backend, "volumeGroup", parameters.VolumeGroup, "pool", parameters.Pool, "size", capacity.Size, "free", capacity.Free)
+		return
+	}
+	klog.InfoS("thin pool capacity", "volumeGroup", parameters.VolumeGroup, "thinPool", parameters.ThinPool, "size", capacity.Size,
+		"virtualSize", capacity.VirtualSize, "dataPercent", capacity.DataPercent, "metadataPercent", capacity.MetadataPercent)
+}
+
+// getCapacityResponse GetCapacity response for a pool. Thin volumes can be as large as what's left of the overcommit
+// limit, thick ones as the free space
+func getCapacityResponse(capacity *poolCapacity, parameters *volumeParameters) *csi.GetCapacityResponse {
+	available := capacity.available(parameters)
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: available,
+		MaximumVolumeSize: wrapperspb.Int64(available),
+		MinimumVolumeSize: wrapperspb.Int64(parameters.SizeGranularity),
+	}
+}
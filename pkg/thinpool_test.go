@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func thinPoolParameters() *volumeParameters {
+	return &volumeParameters{ThinPool: "thinpool", OvercommitRatio: 2, ThinPoolFullPercent: 90, SizeGranularity: defaultSizeGranularity}
+}
+
+func Test_PoolCapacityAvailable(t *testing.T) {
+	parameters := thinPoolParameters()
+
+	assert.Equal(t, int64(150), (&poolCapacity{Size: 100, VirtualSize: 50, DataPercent: 40}).available(parameters))
+	assert.Equal(t, int64(0), (&poolCapacity{Size: 100, VirtualSize: 250}).available(parameters))
+	assert.Equal(t, int64(0), (&poolCapacity{Size: 100, MetadataPercent: 95}).available(parameters))
+	assert.Equal(t, int64(30), (&poolCapacity{Size: 100, Free: 30}).available(&volumeParameters{}))
+}
+
+func Test_CheckThinPoolSpace(t *testing.T) {
+	parameters := thinPoolParameters()
+
+	assert.Nil(t, checkThinPoolSpace(&poolCapacity{Size: 100, VirtualSize: 150}, parameters, 50))
+
+	err := checkThinPoolSpace(&poolCapacity{Size: 100, VirtualSize: 150}, parameters, 51)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	err = checkThinPoolSpace(&poolCapacity{Size: 100, DataPercent: 90}, parameters, 1)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func Test_CreateVolumeThinPool(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{
+		"capacity": `{"Size":10737418240,"DataPercent":12.5,"MetadataPercent":3.1,"VirtualSize":1073741824}`,
+		"create":   testVolumeId,
+	}
+
+	response, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		Parameters:         map[string]string{parameterVolumeGroup: "vg0", parameterThinPool: "thinpool"},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, testVolumeId, response.Volume.VolumeId)
+	assert.Equal(t, "sudo libvirt-storage-attach -operation=capacity -volume-group=vg0 -thin-pool=thinpool", mockSsh.Commands[0])
+	assert.Contains(t, mockSsh.Commands[1], " -thin-pool=thinpool")
+}
+
+func Test_CreateVolumeThinPoolFull(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{
+		"capacity": `{"Size":10737418240,"DataPercent":40,"MetadataPercent":3.1,"VirtualSize":10737418240}`,
+	}
+
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		Parameters:         map[string]string{parameterThinPool: "thinpool"},
+	})
+
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.False(t, mockSsh.ranOperation("create"))
+}
+
+func Test_GetCapacity(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Stdout = `{"Size":10737418240,"DataPercent":20,"MetadataPercent":5,"VirtualSize":16106127360}`
+
+	response, err := controller.GetCapacity(context.Background(), &csi.GetCapacityRequest{
+		Parameters: map[string]string{parameterThinPool: "thinpool", parameterOvercommitRatio: "2"},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5368709120), response.AvailableCapacity)
+	assert.Equal(t, int64(5368709120), response.MaximumVolumeSize.GetValue())
+}
+
+func Test_GetCapacityThickVolumeGroup(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Stdout = `{"Size":10737418240,"Free":4294967296}`
+
+	response, err := controller.GetCapacity(context.Background(), &csi.GetCapacityRequest{})
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4294967296), response.AvailableCapacity)
+	assert.Equal(t, "sudo libvirt-storage-attach -operation=capacity", mockSsh.Commands[0])
+}
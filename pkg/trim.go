@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"context"
+	"expvar"
+	"k8s.io/klog/v2"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// fstrim -v output, "/mnt: 1 GiB (1073741824 bytes) trimmed" or "/mnt: 1073741824 bytes were trimmed" before
+// util-linux 2.28
+var fstrimOutputRegex = regexp.MustCompile(`\(?([0-9]+) bytes\)? (were )?trimmed`)
+
+// Metrics, served on /debug/vars if main starts the metrics endpoint
+var trimRuns = expvar.NewInt("fstrim_runs")
+var trimFailures = expvar.NewInt("fstrim_failures")
+var trimmedBytes = expvar.NewInt("fstrim_trimmed_bytes")
+var trimmedBytesByVolume = expvar.NewMap("fstrim_trimmed_bytes_by_volume")
+
+// parseFstrimOutput Bytes fstrim -v reports as trimmed
+func parseFstrimOutput(output string) (int64, bool) {
+	match := fstrimOutputRegex.FindStringSubmatch(output)
+	if match == nil {
+		return 0, false
+	}
+	trimmed, err := strconv.ParseInt(match[1], 10, 64)
+	return trimmed, err == nil
+}
+
+// nextTrimDelay Interval plus a random part of jitter, so nodes don't all trim (and hit the hypervisor's disks) at once
+func nextTrimDelay(interval time.Duration, jitter time.Duration, random *rand.Rand) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(random.Int63n(int64(jitter)))
+}
+
+// trimVolume Run fstrim on a published volume and return the bytes trimmed
+func trimVolume(ctx context.Context, volumeId string, target string) (int64, error) {
+	out, err := execCommand(ctx, "fstrim", "-v", target).CombinedOutput()
+	if err != nil {
+		klog.ErrorS(err, "fstrim failed", "pv", volumeId, "target", target, "output", string(out))
+		return 0, err
+	}
+	trimmed, ok := parseFstrimOutput(string(out))
+	if !ok {
+		klog.InfoS("couldn't parse fstrim output", "pv", volumeId, "target", target, "output", string(out))
+	}
+	return trimmed, nil
+}
+
+// trimPublishedVolumes Run fstrim on every volume in the registry that's still mounted
+func (s *LibvirtCsiDriver) trimPublishedVolumes(ctx context.Context) {
+	var total int64
+	for target, volumeId := range s.publishedVolumes() {
+		if mounted, err := isMountPoint(target); err != nil || !mounted {
+			klog.InfoS("skipping fstrim, volume isn't mounted", "pv", volumeId, "target", target)
+			continue
+		}
+
+		trimRuns.Add(1)
+		trimmed, err := trimVolume(ctx, volumeId, target)
+		if err != nil {
+			trimFailures.Add(1)
+			continue
+		}
+		klog.InfoS("trimmed volume", "pv", volumeId, "target", target, "bytes", trimmed)
+		trimmedBytes.Add(trimmed)
+		trimmedBytesByVolume.Add(volumeId, trimmed)
+		total += trimmed
+	}
+	klog.InfoS("fstrim of published volumes done", "bytes", total)
+}
+
+// RunPeriodicTrim Trim published volumes every FstrimInterval plus up to FstrimJitter until ctx is done
+func (s *LibvirtCsiDriver) RunPeriodicTrim(ctx context.Context) {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		delay := nextTrimDelay(s.FstrimInterval, s.FstrimJitter, random)
+		klog.InfoS("next fstrim of published volumes", "in", delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+			s.trimPublishedVolumes(ctx)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_ParseFstrimOutput(t *testing.T) {
+	trimmed, ok := parseFstrimOutput("/var/lib/kubelet/pods/x/mount: 1 GiB (1073741824 bytes) trimmed\n")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1073741824), trimmed)
+
+	trimmed, ok = parseFstrimOutput("/mnt: 4096 bytes were trimmed\n")
+	assert.True(t, ok)
+	assert.Equal(t, int64(4096), trimmed)
+
+	_, ok = parseFstrimOutput("fstrim: /mnt: the discard operation is not supported\n")
+	assert.False(t, ok)
+}
+
+func Test_NextTrimDelay(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	assert.Equal(t, time.Hour, nextTrimDelay(time.Hour, 0, random))
+	for i := 0; i < 100; i++ {
+		delay := nextTrimDelay(time.Hour, time.Minute, random)
+		assert.GreaterOrEqual(t, delay, time.Hour)
+		assert.Less(t, delay, time.Hour+time.Minute)
+	}
+}
+
+func Test_PublishedVolumesRegistry(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "published-volumes.json")
+	driver := &LibvirtCsiDriver{PublishedVolumesFile: file}
+
+	driver.addPublishedVolume(testVolumeId, "/pods/a/mount")
+	driver.addPublishedVolume("zfs:"+testVolumeId, "/pods/b/mount")
+	driver.removePublishedVolume("/pods/b/mount")
+	driver.removePublishedVolume("/pods/c/mount")
+
+	// A restarted plugin reads the registry back
+	restarted := &LibvirtCsiDriver{PublishedVolumesFile: file}
+	assert.Equal(t, map[string]string{"/pods/a/mount": testVolumeId}, restarted.publishedVolumes())
+}
+
+func Test_TrimVolume(t *testing.T) {
+	commands := fakeCommands(t, func(name string, args []string) (string, int) {
+		return "/pods/a/mount: 1 GiB (1073741824 bytes) trimmed\n", 0
+	})
+
+	trimmed, err := trimVolume(context.Background(), testVolumeId, "/pods/a/mount")
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1073741824), trimmed)
+	assert.Equal(t, []string{"fstrim -v /pods/a/mount"}, *commands)
+
+	fakeCommands(t, func(name string, args []string) (string, int) {
+		return "fstrim: /pods/a/mount: the discard operation is not supported", 1
+	})
+	_, err = trimVolume(context.Background(), testVolumeId, "/pods/a/mount")
+	assert.NotNil(t, err)
+}
+
+func Test_TrimPublishedVolumes(t *testing.T) {
+	mounted := t.TempDir()
+	unmounted := t.TempDir()
+	fakeMountInfo(t, "98 22 8:17 / "+mounted+" rw,relatime - ext4 /dev/sdb1 rw\n")
+	commands := fakeCommands(t, func(name string, args []string) (string, int) {
+		return args[1] + ": 4096 bytes were trimmed\n", 0
+	})
+	driver := &LibvirtCsiDriver{PublishedVolumesFile: filepath.Join(t.TempDir(), "published-volumes.json")}
+	driver.addPublishedVolume(testVolumeId, mounted)
+	driver.addPublishedVolume("zfs:"+testVolumeId, unmounted)
+
+	driver.trimPublishedVolumes(context.Background())
+
+	assert.Equal(t, []string{"fstrim -v " + mounted}, *commands)
+}
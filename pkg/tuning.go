@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// StorageClass parameters for the libvirt <driver> attributes and <iotune> limits of attached disks. They're carried
+// in the VolumeContext and applied by ControllerPublishVolume
+const parameterCacheMode = "cacheMode"         // <driver cache=>
+const parameterIoMode = "ioMode"               // <driver io=>
+const parameterDiscard = "discard"             // <driver discard=>
+const parameterDetectZeroes = "detectZeroes"   // <driver detect_zeroes=>
+const parameterTotalBytesSec = "totalBytesSec" // <iotune><total_bytes_sec>
+const parameterTotalIopsSec = "totalIopsSec"   // <iotune><total_iops_sec>
+
+var cacheModes = map[string]struct{}{"default": {}, "none": {}, "writethrough": {}, "writeback": {}, "directsync": {}, "unsafe": {}}
+var ioModes = map[string]struct{}{"native": {}, "threads": {}, "io_uring": {}}
+var discardModes = map[string]struct{}{"ignore": {}, "unmap": {}}
+var detectZeroesModes = map[string]struct{}{"off": {}, "on": {}, "unmap": {}}
+
+// Discards from the guest are passed on so thin and file backed volumes get freed space back. discard: ignore opts out
+const defaultDiscard = "unmap"
+
+// Parameters ControllerModifyVolume can change, i.e. what a VolumeAttributesClass may set
+var mutableParameters = map[string]struct{}{
+	parameterCacheMode:     {},
+	parameterIoMode:        {},
+	parameterDiscard:       {},
+	parameterDetectZeroes:  {},
+	parameterTotalBytesSec: {},
+	parameterTotalIopsSec:  {},
+}
+
+// diskTuning libvirt disk settings for a volume. Empty values leave the helper's defaults
+type diskTuning struct {
+	CacheMode     string
+	IoMode        string
+	Discard       string
+	DetectZeroes  string
+	TotalBytesSec int64
+	TotalIopsSec  int64
+}
+
+// parseDiskTuning Parse the tuning parameters from StorageClass parameters or a VolumeContext. The discard default
+// is applied here so CreateVolume, publish and modify all check the same effective settings
+func parseDiskTuning(parameters map[string]string, multiAttach bool) (*diskTuning, error) {
+	tuning := &diskTuning{
+		CacheMode:    parameters[parameterCacheMode],
+		IoMode:       parameters[parameterIoMode],
+		Discard:      parameters[parameterDiscard],
+		DetectZeroes: parameters[parameterDetectZeroes],
+	}
+	for key, value := range map[string]string{
+		parameterCacheMode:    tuning.CacheMode,
+		parameterIoMode:       tuning.IoMode,
+		parameterDiscard:      tuning.Discard,
+		parameterDetectZeroes: tuning.DetectZeroes,
+	} {
+		if err := validateTuningMode(key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if tuning.Discard == "" {
+		tuning.Discard = defaultDiscard
+	}
+
+	for key, target := range map[string]*int64{
+		parameterTotalBytesSec: &tuning.TotalBytesSec,
+		parameterTotalIopsSec:  &tuning.TotalIopsSec,
+	} {
+		value, ok := parameters[key]
+		if !ok {
+			continue
+		}
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid %s parameter %q, must be a positive integer", key, value)
+		}
+		*target = parsed
+	}
+
+	// Shared disks must not be cached on the host, every domain would see its own cache
+	if multiAttach && tuning.CacheMode != "" && tuning.CacheMode != "none" {
+		return nil, fmt.Errorf("%s volumes require %s none, got %q", parameterMultiAttach, parameterCacheMode, tuning.CacheMode)
+	}
+	// QEMU only does native AIO with O_DIRECT
+	if tuning.IoMode == "native" && tuning.CacheMode != "" && tuning.CacheMode != "none" && tuning.CacheMode != "directsync" {
+		return nil, fmt.Errorf("%s native requires %s none or directsync, got %q", parameterIoMode, parameterCacheMode, tuning.CacheMode)
+	}
+	if tuning.DetectZeroes == "unmap" && tuning.Discard != "unmap" {
+		return nil, fmt.Errorf("%s unmap requires %s unmap", parameterDetectZeroes, parameterDiscard)
+	}
+	return tuning, nil
+}
+
+// validateTuningMode Check a <driver> attribute value is one libvirt knows
+func validateTuningMode(key string, value string) error {
+	if value == "" {
+		return nil
+	}
+	modes := map[string]map[string]struct{}{
+		parameterCacheMode:    cacheModes,
+		parameterIoMode:       ioModes,
+		parameterDiscard:      discardModes,
+		parameterDetectZeroes: detectZeroesModes,
+	}[key]
+	if _, ok := modes[value]; !ok {
+		return fmt.Errorf("invalid %s parameter %q", key, value)
+	}
+	return nil
+}
+
+// volumeContext Tuning parameters that are set, in the form parseDiskTuning reads them. Defaults are left out
+func (t *diskTuning) volumeContext() map[string]string {
+	volumeContext := map[string]string{}
+	for key, value := range map[string]string{
+		parameterCacheMode:    t.CacheMode,
+		parameterIoMode:       t.IoMode,
+		parameterDetectZeroes: t.DetectZeroes,
+	} {
+		if value != "" {
+			volumeContext[key] = value
+		}
+	}
+	if t.Discard != defaultDiscard {
+		volumeContext[parameterDiscard] = t.Discard
+	}
+	if t.TotalBytesSec > 0 {
+		volumeContext[parameterTotalBytesSec] = strconv.FormatInt(t.TotalBytesSec, 10)
+	}
+	if t.TotalIopsSec > 0 {
+		volumeContext[parameterTotalIopsSec] = strconv.FormatInt(t.TotalIopsSec, 10)
+	}
+	return volumeContext
+}
+
+// mergeTuningParameters Tuning parameters of base, overridden by the ones in overrides. At publish the base is the
+// VolumeContext and the overrides what ControllerModifyVolume stored on the volume
+func mergeTuningParameters(base map[string]string, overrides map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, parameters := range []map[string]string{base, overrides} {
+		for key, value := range parameters {
+			if _, ok := mutableParameters[key]; ok {
+				merged[key] = value
+			}
+		}
+	}
+	return merged
+}
+
+// apply Set the tuning on an attach or modify request
+func (t *diskTuning) apply(request *HelperRequest) {
+	request.CacheMode = t.CacheMode
+	request.IoMode = t.IoMode
+	request.Discard = t.Discard
+	request.DetectZeroes = t.DetectZeroes
+	request.TotalBytesSec = t.TotalBytesSec
+	request.TotalIopsSec = t.TotalIopsSec
+}
@@ -0,0 +1,235 @@
+package pkg
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func Test_ParseDiskTuning(t *testing.T) {
+	tuning, err := parseDiskTuning(map[string]string{
+		parameterCacheMode:     "none",
+		parameterIoMode:        "native",
+		parameterDiscard:       "unmap",
+		parameterDetectZeroes:  "unmap",
+		parameterTotalBytesSec: "104857600",
+		parameterTotalIopsSec:  "1000",
+	}, false)
+
+	assert.Nil(t, err)
+	assert.Equal(t, &diskTuning{CacheMode: "none", IoMode: "native", Discard: "unmap", DetectZeroes: "unmap",
+		TotalBytesSec: 104857600, TotalIopsSec: 1000}, tuning)
+	assert.Equal(t, "1000", tuning.volumeContext()[parameterTotalIopsSec])
+
+	tuning, err = parseDiskTuning(nil, true)
+	assert.Nil(t, err)
+	assert.Equal(t, defaultDiscard, tuning.Discard)
+	assert.Empty(t, tuning.volumeContext())
+
+	// detectZeroes unmap only needs the default discard
+	tuning, err = parseDiskTuning(map[string]string{parameterDetectZeroes: "unmap"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{parameterDetectZeroes: "unmap"}, tuning.volumeContext())
+}
+
+func Test_ParseDiskTuningInvalid(t *testing.T) {
+	for _, parameters := range []map[string]string{
+		{parameterCacheMode: "fast"},
+		{parameterIoMode: "aio"},
+		{parameterDiscard: "on"},
+		{parameterDetectZeroes: "yes"},
+		{parameterTotalIopsSec: "0"},
+		{parameterTotalBytesSec: "100Mi"},
+		{parameterIoMode: "native", parameterCacheMode: "writeback"},
+		{parameterDetectZeroes: "unmap", parameterDiscard: "ignore"},
+	} {
+		_, err := parseDiskTuning(parameters, false)
+		assert.NotNil(t, err, parameters)
+	}
+
+	_, err := parseDiskTuning(map[string]string{parameterCacheMode: "writeback"}, true)
+	assert.NotNil(t, err)
+}
+
+func Test_PublishVolumeTuning(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": testListOutput}
+
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:           "node-1",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    map[string]string{parameterCacheMode: "none", parameterDiscard: "unmap", parameterTotalIopsSec: "500"},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "sudo libvirt-storage-attach -operation=attach -pv-id=pv-a61a74d2-ab75-458b-bf1b-0216923ca686 -vm-name=node-1 -cache=none -discard=unmap -total-iops-sec=500", mockSsh.Commands[1])
+}
+
+func Test_PublishVolumeInvalidTuning(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": testListOutput}
+
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:           "node-1",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    map[string]string{parameterCacheMode: "fast"},
+	})
+
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.False(t, mockSsh.ranOperation("attach"))
+}
+
+func Test_ModifyVolume(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{
+		"list": `[{"Id":"pv-a61a74d2-ab75-458b-bf1b-0216923ca686","Owners":["node-1"],
+			"Attributes":{"multiAttach":"false","cacheMode":"none","totalIopsSec":"500"}}]`,
+	}
+
+	_, err := controller.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{
+		VolumeId:          "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		MutableParameters: map[string]string{parameterTotalIopsSec: "2000", parameterTotalBytesSec: "52428800"},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "sudo libvirt-storage-attach -operation=modify -pv-id=pv-a61a74d2-ab75-458b-bf1b-0216923ca686 -cache=none -discard=unmap -total-bytes-sec=52428800 -total-iops-sec=2000", mockSsh.Commands[1])
+}
+
+func Test_ModifyVolumeInvalid(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": `[{"Id":"pv-a61a74d2-ab75-458b-bf1b-0216923ca686","Owners":["node-1","node-2"],
+		"Attributes":{"multiAttach":"true"}}]`}
+
+	for _, parameters := range []map[string]string{
+		{parameterVolumeGroup: "vg1"},
+		{parameterTotalIopsSec: "-1"},
+		{parameterCacheMode: "writeback"},
+	} {
+		_, err := controller.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{
+			VolumeId:          "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+			MutableParameters: parameters,
+		})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), parameters)
+	}
+	assert.False(t, mockSsh.ranOperation("modify"))
+
+	_, err := controller.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{
+		VolumeId:          "pv-00000000-0000-0000-0000-000000000000",
+		MutableParameters: map[string]string{parameterTotalIopsSec: "100"},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func Test_ModifyVolumeChecksStoredSettings(t *testing.T) {
+	for _, test := range []struct {
+		attributes string
+		parameters map[string]string
+		code       codes.Code
+	}{
+		// The StorageClass asked for native AIO, publish would reject a cached mode
+		{`{"multiAttach":"false","ioMode":"native"}`, map[string]string{parameterCacheMode: "writeback"}, codes.InvalidArgument},
+		// Shared volumes can't be cached, whether or not they're attached anywhere right now
+		{`{"multiAttach":"true"}`, map[string]string{parameterCacheMode: "writeback"}, codes.InvalidArgument},
+		{`{"multiAttach":"false","ioMode":"native"}`, map[string]string{parameterCacheMode: "directsync"}, codes.OK},
+		// Created by a helper that didn't store the settings
+		{`{"totalIopsSec":"500"}`, map[string]string{parameterTotalIopsSec: "1000"}, codes.OK},
+		{`null`, map[string]string{parameterCacheMode: "writeback"}, codes.OK},
+	} {
+		mockSsh, controller := newController()
+		mockSsh.Outputs = map[string]string{"list": `[{"Id":"pv-a61a74d2-ab75-458b-bf1b-0216923ca686","Owners":["node-1"],"Attributes":` + test.attributes + `}]`}
+
+		_, err := controller.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{
+			VolumeId:          "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+			MutableParameters: test.parameters,
+		})
+		assert.Equal(t, test.code, status.Code(err), test.attributes)
+		assert.Equal(t, test.code == codes.OK, mockSsh.ranOperation("modify"), test.attributes)
+	}
+}
+
+func Test_CreateVolumeStoresSettings(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"create": "pv-a61a74d2-ab75-458b-bf1b-0216923ca686\n"}
+
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{multiNodeBlockCapability()},
+		Parameters:         map[string]string{parameterMultiAttach: "true", parameterIoMode: "native"},
+	})
+
+	assert.Nil(t, err)
+	assert.Contains(t, mockSsh.Commands[0], " -io=native -size=1073741824 -shareable")
+}
+
+func Test_CreateVolumeOnlySendsSetParameters(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"create": "pv-a61a74d2-ab75-458b-bf1b-0216923ca686\n"}
+
+	_, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "sudo libvirt-storage-attach -operation=create -size=1073741824", mockSsh.Commands[0])
+}
+
+func Test_PublishVolumeModifiedTuning(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": `[{"Id":"pv-a61a74d2-ab75-458b-bf1b-0216923ca686","Owners":[],"Attributes":{"totalIopsSec":"2000"}}]`}
+
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:           "node-1",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    map[string]string{parameterCacheMode: "none", parameterTotalIopsSec: "500"},
+	})
+
+	assert.Nil(t, err)
+	assert.Contains(t, mockSsh.Commands[1], " -cache=none -discard=unmap -total-iops-sec=2000")
+}
+
+func Test_PublishVolumeDiscardIgnore(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"list": testListOutput}
+
+	_, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pv-a61a74d2-ab75-458b-bf1b-0216923ca686",
+		NodeId:           "node-1",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    map[string]string{parameterDiscard: "ignore"},
+	})
+
+	assert.Nil(t, err)
+	assert.Contains(t, mockSsh.Commands[1], " -discard=ignore")
+}
+
+func Test_DiscardIgnoreReachesHelper(t *testing.T) {
+	mockSsh, controller := newController()
+	mockSsh.Outputs = map[string]string{"create": testVolumeId + "\n", "list": `[{"Id":"` + testVolumeId + `","Owners":[]}]`}
+
+	created, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		Parameters:         map[string]string{parameterDiscard: "ignore"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "sudo libvirt-storage-attach -operation=create -discard=ignore -size=1073741824", mockSsh.Commands[0])
+
+	_, err = controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         created.Volume.VolumeId,
+		NodeId:           "node-1",
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeContext:    created.Volume.VolumeContext,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "sudo libvirt-storage-attach -operation=attach -pv-id="+testVolumeId+" -vm-name=node-1 -discard=ignore", mockSsh.Commands[2])
+}
@@ -3,9 +3,36 @@ package pkg
 import (
 	"encoding/json"
 	"k8s.io/klog/v2"
+	"os"
+	"os/exec"
 )
 
+// execCommand Starts the tools the node plugin runs, replaced by tests to fake them
+var execCommand = exec.CommandContext
+
 func logRequest(method string, value any) {
 	jsonRequest, _ := json.Marshal(value)
 	klog.InfoS("received request", "method", method, "request", jsonRequest)
 }
+
+// readJsonFile Decode a state file written by writeJsonFile. A missing file returns an os.ErrNotExist error
+func readJsonFile(file string, value any) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, value)
+}
+
+// writeJsonFile Replace a state file atomically so a crash leaves either the old or the new content
+func writeJsonFile(file string, value any) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	temp := file + ".tmp"
+	if err := os.WriteFile(temp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, file)
+}